@@ -132,11 +132,26 @@ func (r *Redis) Script(cmd int, keys []string, args ...interface{}) (interface{}
 	return re, nil
 }
 
+//redis订阅者，只接收channels中的消息
+type redisSub struct {
+	fun      func(channel, data string)
+	channels map[string]bool
+}
+
+func newRedisSub(fun func(channel, data string), channels []string) *redisSub {
+	sub := &redisSub{fun: fun, channels: map[string]bool{}}
+	for _, v := range channels {
+		sub.channels[v] = true
+	}
+	return sub
+}
+
 type RedisManager struct {
 	dbs      map[int]*Redis
 	subMap   map[string]*Redis
-	channels []string
-	fun      func(channel, data string)
+	channels []string    //所有订阅者的频道
+	sub      *redisSub   //Sub设置的订阅者
+	subs     []*redisSub //AddSub追加的订阅者
 	lock     sync.RWMutex
 }
 
@@ -151,31 +166,81 @@ func (r *RedisManager) GetGlobal() *Redis {
 	return r.GetByRid(0)
 }
 
+//设置订阅，替换之前Sub设置的频道和回调，AddSub追加的订阅保留
 func (r *RedisManager) Sub(fun func(channel, data string), channels ...string) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.channels = channels
-	r.fun = fun
+	r.sub = newRedisSub(fun, channels)
+	r.resubscribe()
+}
+
+//追加订阅，保留已有的频道和回调，fun只接收channels中的消息
+func (r *RedisManager) AddSub(fun func(channel, data string), channels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.subs = append(r.subs, newRedisSub(fun, channels))
+	r.resubscribe()
+}
+
+//按所有订阅者的频道重新订阅，需要持有写锁
+func (r *RedisManager) resubscribe() {
+	subs := r.subs
+	if r.sub != nil {
+		subs = append([]*redisSub{r.sub}, subs...)
+	}
+	seen := map[string]bool{}
+	r.channels = r.channels[:0]
+	for _, sub := range subs {
+		for channel := range sub.channels {
+			if !seen[channel] {
+				seen[channel] = true
+				r.channels = append(r.channels, channel)
+			}
+		}
+	}
 	for _, v := range r.subMap {
 		if v.pubsub != nil {
 			v.pubsub.Close()
 		}
-		pubsub := v.Subscribe(channels...)
-		v.pubsub = pubsub
-		LogInfo("[redis]config:%v, subscribe channel:%v", v.conf, channels)
-		goForRedis(func() {
-			for IsRuning() {
-				msg, err := pubsub.ReceiveMessage()
-				if err == nil {
-					Go(func() { fun(msg.Channel, msg.Payload) })
-				} else if _, ok := err.(net.Error); !ok {
-					if err.Error() != "redis: reply is empty" {
-						LogFatal("[redis]pubsub broken err:%v", err)
-						break
-					}
+		r.subscribe(v)
+	}
+}
+
+//订阅所有频道并接收消息，需要持有写锁
+func (r *RedisManager) subscribe(v *Redis) {
+	pubsub := v.Subscribe(r.channels...)
+	v.pubsub = pubsub
+	LogInfo("[redis]config:%v, subscribe channel:%v", v.conf, r.channels)
+	goForRedis(func() {
+		for IsRuning() {
+			msg, err := pubsub.ReceiveMessage()
+			if err == nil {
+				Go(func() { r.dispatch(msg.Channel, msg.Payload) })
+			} else if _, ok := err.(net.Error); !ok {
+				if err.Error() != "redis: reply is empty" {
+					LogFatal("[redis]pubsub broken err:%v", err)
+					break
 				}
 			}
-		})
+		}
+	})
+}
+
+//将消息交给订阅了该频道的订阅者
+func (r *RedisManager) dispatch(channel, data string) {
+	r.lock.RLock()
+	var funs []func(channel, data string)
+	if r.sub != nil && r.sub.channels[channel] {
+		funs = append(funs, r.sub.fun)
+	}
+	for _, sub := range r.subs {
+		if sub.channels[channel] {
+			funs = append(funs, sub.fun)
+		}
+	}
+	r.lock.RUnlock()
+	for _, fun := range funs {
+		fun(channel, data)
 	}
 }
 
@@ -222,25 +287,10 @@ func (r *RedisManager) Add(id int, conf *RedisConfig) {
 		}
 	})
 
-	if v, ok := r.subMap[conf.Addr]; !ok {
+	if _, ok := r.subMap[conf.Addr]; !ok {
 		r.subMap[conf.Addr] = re
 		if len(r.channels) > 0 {
-			pubsub := re.Subscribe(r.channels...)
-			re.pubsub = pubsub
-			LogInfo("[redis]config:%v, subscribe channel:%v", v.conf, r.channels)
-			goForRedis(func() {
-				for IsRuning() {
-					msg, err := pubsub.ReceiveMessage()
-					if err == nil {
-						Go(func() { r.fun(msg.Channel, msg.Payload) })
-					} else if _, ok := err.(net.Error); !ok {
-						if err.Error() != "redis: reply is empty" {
-							LogFatal("[redis]pubsub broken err:%v", err)
-							break
-						}
-					}
-				}
-			})
+			r.subscribe(re)
 		}
 	}
 	r.dbs[id] = re
@@ -76,6 +76,11 @@ var (
 	ErrNetUnreachable      = NewError("网络不可达", 25)
 	ErrMsgNoHandle         = NewError("消息未注册", 26)
 	ErrMicroServerNotFound = NewError("找不到微服务", 27)
+	ErrNetClosed           = NewError("连接已关闭", 28)
+	ErrCallBusy            = NewError("等待回应的请求过多", 29)
+	ErrProxyProtocol       = NewError("PROXY协议头错误", 30)
+	ErrWsPathExist         = NewError("ws路径已存在", 31)
+	ErrProxyNoTrusted      = NewError("PROXY协议未设置可信来源", 32)
 
 	ErrErrIdNotFound = NewError("错误没有对应的错误码", 50)
 )
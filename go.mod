@@ -11,6 +11,7 @@ require (
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.19.0 // indirect
 	github.com/smartwalle/dbs v1.2.0
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 )
 replace (
 	easyutil v0.0.0 => ../easyutil
@@ -127,19 +127,35 @@ type RouteMap = map[string]func(w http.ResponseWriter, r *http.Request)
 
 //http启动参数
 type HttpStartParam struct {
-	Addr       string   //ip:pport
-	UseHttps   bool     //是否使用https
-	SSLCrtPath string   //SSLCrt路径
-	SSLKeyPath string   //SSLKey路径
-	RouteMap   RouteMap //路由表
+	Addr       string         //ip:pport
+	UseHttps   bool           //是否使用https
+	SSLCrtPath string         //SSLCrt路径
+	SSLKeyPath string         //SSLKey路径
+	RouteMap   RouteMap       //路由表
+	Mux        *http.ServeMux //路由使用的mux，为nil时使用http.DefaultServeMux
+}
+
+//http服务
+type HttpServer struct {
+	*http.Server
+	Mux *http.ServeMux
+}
+
+//在http服务上挂载ws路径，与http服务共用端口
+func (r *HttpServer) HandleWs(url string, typ MsgType, handler IMsgHandler, parser IParserFactory, opts *MsgQueOptions) error {
+	return startWsHandler(r.Mux, url, typ, handler, parser, opts)
 }
 
 //启动http服务
-func StartHttp(startParam *HttpStartParam) {
+func StartHttp(startParam *HttpStartParam) *HttpServer {
+	mux := startParam.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
 	for k, v := range startParam.RouteMap {
-		http.Handle(k, tryHandler(http.HandlerFunc(v)))
+		mux.Handle(k, tryHandler(http.HandlerFunc(v)))
 	}
-	s := &http.Server{Addr: startParam.Addr}
+	s := &http.Server{Addr: startParam.Addr, Handler: mux}
 	Go(func() {
 		if startParam.UseHttps {
 			if startParam.SSLCrtPath == "" || startParam.SSLKeyPath == "" {
@@ -169,6 +185,7 @@ func StartHttp(startParam *HttpStartParam) {
 			s.Close()
 		}
 	})
+	return &HttpServer{Server: s, Mux: mux}
 }
 
 //示例
@@ -20,14 +20,28 @@ var (
 )
 
 var Config = struct {
-	AutoEncrypt     bool
-	AutoCompressLen uint32
-	SSLCrtPath      string
-	SSLKeyPath      string
-	EnableWss       bool
-	ReadDataBuffer  int
-	TCPNoDelay      bool
-}{ReadDataBuffer: 1 << 12, TCPNoDelay: true}
+	AutoEncrypt       bool
+	AutoCompressLen   uint32
+	Compressor        uint8 //默认压缩算法id，消息队列可通过SetCompressor单独设置
+	SSLCrtPath        string
+	SSLKeyPath        string
+	EnableWss         bool
+	ReadDataBuffer    int
+	TCPNoDelay        bool
+	RudpInterval      int  //可靠udp刷新间隔 ms
+	RudpSndWnd        int  //可靠udp发送窗口
+	RudpRcvWnd        int  //可靠udp接收窗口
+	RudpMtu           int  //可靠udp数据报长度，用于拥塞控制
+	RudpNoCwnd        bool //可靠udp关闭拥塞控制，仅受发送窗口与远端窗口限制，适用于对延迟敏感的场景
+	CallTimeout       int  //Call和CallAsync的默认超时 ms，0表示不超时，Call的ctx带截止时间时以ctx为准
+	WriteBatchSize    int  //tcp合并写入的最大字节数，超过后立即写入，0表示每条消息单独写入
+	WriteBatchDelay   int  //tcp合并写入时等待更多消息的时间 ms，0表示只合并已经在写入通道中的消息
+	MsgBufferPool     bool //tcp和ws收发使用缓冲区池，处理函数返回后消息数据会被复用
+	MsgBufferDebug    bool //检查缓冲区释放后被修改和重复释放，有性能损耗，仅用于调试
+	HeartbeatInterval int  //心跳间隔 s，0表示不发送心跳，消息队列可通过SetHeartbeat单独设置
+	HeartbeatMiss     int  //连续多少个心跳间隔没有收到回应时关闭连接，0表示不关闭
+	UdpMaxPeers       int  //udp监听的最大远端数量，超过后丢弃新地址的数据报，0表示不限制
+}{ReadDataBuffer: 1 << 12, TCPNoDelay: true, RudpInterval: 10, RudpSndWnd: 128, RudpRcvWnd: 128, RudpMtu: 1400, CallTimeout: 10000, WriteBatchSize: 1 << 16, HeartbeatMiss: 3, UdpMaxPeers: 10000}
 
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
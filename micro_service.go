@@ -0,0 +1,334 @@
+/*
+@Time       : 2022/7/20
+@Author     : wuqiusheng
+@File       : micro_service.go
+@Description: 微服务注册与发现，基于redis
+			服务信息存放在hash prefix:name中，field为服务id，值为json
+			存活时间存放在zset prefix:name:alive中，score为过期时间 ms，注册后按ttl/3间隔续期
+			注册和注销时向频道prefix:event发布服务名，订阅方收到后重新拉取，过期的服务在定时拉取时清理
+*/
+package easynet
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var DefMicroServicePrefix = "easynet:service"
+
+//微服务信息
+type MicroService struct {
+	Name string            `json:"name"` //服务名
+	Id   string            `json:"id"`   //服务id，同名服务中唯一
+	Addr string            `json:"addr"` //连接地址，StartConnect使用
+	Meta map[string]string `json:"meta"` //自定义数据
+}
+
+func (r *MicroService) key() string {
+	return r.Name + "/" + r.Id
+}
+
+//服务变化回调，added为新增或地址变化的服务，removed为移除的服务
+type MicroServiceWatchFunc func(added, removed []*MicroService)
+
+type microWatcher struct {
+	services map[string]*MicroService
+	funs     []MicroServiceWatchFunc
+	lock     sync.Mutex //保证同一服务名的拉取和回调顺序执行
+}
+
+type MicroServiceRegistry struct {
+	redis    *RedisManager
+	prefix   string
+	ttl      int //s
+	services map[string]*MicroService
+	watchers map[string]*microWatcher
+	subOnce  sync.Once
+	tickOnce sync.Once
+	lock     sync.Mutex
+}
+
+/*
+	创建服务注册中心
+	ttl 服务存活时间 s，超过ttl未续期的服务视为下线
+	prefix 为空时使用DefMicroServicePrefix
+*/
+func NewMicroServiceRegistry(manager *RedisManager, ttl int, prefix string) *MicroServiceRegistry {
+	if ttl < 3 {
+		ttl = 3
+	}
+	if prefix == "" {
+		prefix = DefMicroServicePrefix
+	}
+	return &MicroServiceRegistry{
+		redis:    manager,
+		prefix:   prefix,
+		ttl:      ttl,
+		services: map[string]*MicroService{},
+		watchers: map[string]*microWatcher{},
+	}
+}
+
+func (r *MicroServiceRegistry) infoKey(name string) string {
+	return r.prefix + ":" + name
+}
+
+func (r *MicroServiceRegistry) aliveKey(name string) string {
+	return r.prefix + ":" + name + ":alive"
+}
+
+func (r *MicroServiceRegistry) channel() string {
+	return r.prefix + ":event"
+}
+
+//注册服务，进程关闭时自动注销
+func (r *MicroServiceRegistry) Register(service *MicroService) error {
+	data, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+	if err := r.renew(service.Name, service.Id, data); err != nil {
+		LogError("[redis]register service:%v id:%v failed err:%v", service.Name, service.Id, err)
+		return err
+	}
+	r.lock.Lock()
+	r.services[service.key()] = service
+	r.lock.Unlock()
+	r.publish(service.Name)
+	r.startTick()
+	LogInfo("[redis]register service:%v id:%v addr:%v", service.Name, service.Id, service.Addr)
+	return nil
+}
+
+//注销服务
+func (r *MicroServiceRegistry) Deregister(name, id string) error {
+	r.lock.Lock()
+	delete(r.services, name+"/"+id)
+	r.lock.Unlock()
+	db := r.redis.GetGlobal()
+	pipe := db.TxPipeline()
+	pipe.HDel(r.infoKey(name), id)
+	pipe.ZRem(r.aliveKey(name), id)
+	if _, err := pipe.Exec(); RedisError(err) {
+		LogError("[redis]deregister service:%v id:%v failed err:%v", name, id, err)
+		return err
+	}
+	r.publish(name)
+	LogInfo("[redis]deregister service:%v id:%v", name, id)
+	return nil
+}
+
+//写入服务信息并续期
+func (r *MicroServiceRegistry) renew(name, id string, data []byte) error {
+	db := r.redis.GetGlobal()
+	pipe := db.TxPipeline()
+	pipe.HSet(r.infoKey(name), id, data)
+	pipe.ZAdd(r.aliveKey(name), redis.Z{Score: float64(time.Now().UnixNano()/1000000 + int64(r.ttl)*1000), Member: id})
+	_, err := pipe.Exec()
+	if RedisError(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *MicroServiceRegistry) publish(name string) {
+	if err := r.redis.GetGlobal().Publish(r.channel(), name).Err(); RedisError(err) {
+		LogError("[redis]publish service:%v event failed err:%v", name, err)
+	}
+}
+
+//获取可用的服务列表，没有可用服务时返回ErrMicroServerNotFound
+func (r *MicroServiceRegistry) Services(name string) ([]*MicroService, error) {
+	db := r.redis.GetGlobal()
+	now := strconv.FormatInt(time.Now().UnixNano()/1000000, 10)
+	//清理过期的服务
+	expired, err := db.ZRangeByScore(r.aliveKey(name), redis.ZRangeBy{Min: "-inf", Max: "(" + now}).Result()
+	if RedisError(err) {
+		return nil, err
+	}
+	if len(expired) > 0 {
+		pipe := db.TxPipeline()
+		pipe.HDel(r.infoKey(name), expired...)
+		pipe.ZRemRangeByScore(r.aliveKey(name), "-inf", "("+now)
+		if _, err := pipe.Exec(); RedisError(err) {
+			LogError("[redis]clean service:%v expired:%v failed err:%v", name, expired, err)
+		}
+	}
+
+	ids, err := db.ZRangeByScore(r.aliveKey(name), redis.ZRangeBy{Min: now, Max: "+inf"}).Result()
+	if RedisError(err) {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, ErrMicroServerNotFound
+	}
+	datas, err := db.HMGet(r.infoKey(name), ids...).Result()
+	if RedisError(err) {
+		return nil, err
+	}
+	list := make([]*MicroService, 0, len(datas))
+	for i, v := range datas {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		service := &MicroService{}
+		if err := json.Unmarshal([]byte(str), service); err != nil {
+			LogError("[redis]service:%v id:%v data err:%v", name, ids[i], err)
+			continue
+		}
+		list = append(list, service)
+	}
+	if len(list) == 0 {
+		return nil, ErrMicroServerNotFound
+	}
+	return list, nil
+}
+
+//监听服务变化，添加时先回调一次当前已知的服务
+func (r *MicroServiceRegistry) Watch(name string, fun MicroServiceWatchFunc) {
+	r.subOnce.Do(func() {
+		r.redis.AddSub(func(channel, data string) {
+			r.resync(data)
+		}, r.channel())
+	})
+
+	r.lock.Lock()
+	w, ok := r.watchers[name]
+	if !ok {
+		w = &microWatcher{services: map[string]*MicroService{}}
+		r.watchers[name] = w
+	}
+	r.lock.Unlock()
+
+	w.lock.Lock()
+	w.funs = append(w.funs, fun)
+	if len(w.services) > 0 {
+		added := make([]*MicroService, 0, len(w.services))
+		for _, v := range w.services {
+			added = append(added, v)
+		}
+		fun(added, nil)
+	}
+	w.lock.Unlock()
+	r.startTick()
+	r.resync(name)
+}
+
+//重新拉取服务列表，与已知列表比较后回调
+func (r *MicroServiceRegistry) resync(name string) {
+	r.lock.Lock()
+	w := r.watchers[name]
+	r.lock.Unlock()
+	if w == nil {
+		return
+	}
+	list, err := r.Services(name)
+	if err != nil && err != ErrMicroServerNotFound {
+		LogError("[redis]resync service:%v failed err:%v", name, err)
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var added, removed []*MicroService
+	services := map[string]*MicroService{}
+	for _, v := range list {
+		services[v.Id] = v
+		if old, ok := w.services[v.Id]; !ok || old.Addr != v.Addr {
+			if ok {
+				removed = append(removed, old)
+			}
+			added = append(added, v)
+		}
+	}
+	for id, v := range w.services {
+		if _, ok := services[id]; !ok {
+			removed = append(removed, v)
+		}
+	}
+	w.services = services
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	LogInfo("[redis]service:%v changed added:%v removed:%v", name, len(added), len(removed))
+	for _, fun := range w.funs {
+		fun(added, removed)
+	}
+}
+
+//定时续期已注册的服务，重新拉取监听的服务，关闭时注销已注册的服务
+func (r *MicroServiceRegistry) startTick() {
+	r.tickOnce.Do(func() {
+		Go2(func(cstop chan struct{}) {
+			tick := time.NewTicker(time.Millisecond * time.Duration(r.ttl*1000/3))
+			defer tick.Stop()
+			defer r.deregisterAll()
+			for IsRuning() {
+				select {
+				case <-cstop:
+					return
+				case <-tick.C:
+					r.tick()
+				}
+			}
+		})
+	})
+}
+
+//注销本进程注册的所有服务，退出时调用
+func (r *MicroServiceRegistry) deregisterAll() {
+	r.lock.Lock()
+	list := make([]*MicroService, 0, len(r.services))
+	for _, v := range r.services {
+		list = append(list, v)
+	}
+	r.lock.Unlock()
+	for _, v := range list {
+		r.Deregister(v.Name, v.Id)
+	}
+}
+
+func (r *MicroServiceRegistry) tick() {
+	r.lock.Lock()
+	services := make([]*MicroService, 0, len(r.services))
+	for _, v := range r.services {
+		services = append(services, v)
+	}
+	names := make([]string, 0, len(r.watchers))
+	for name := range r.watchers {
+		names = append(names, name)
+	}
+	r.lock.Unlock()
+
+	for _, v := range services {
+		data, _ := json.Marshal(v)
+		if err := r.renew(v.Name, v.Id, data); err != nil {
+			LogError("[redis]renew service:%v id:%v failed err:%v", v.Name, v.Id, err)
+		}
+	}
+	for _, name := range names {
+		r.resync(name)
+	}
+}
+
+/*
+	解析服务并自动连接，返回的连接池随服务上下线增减地址
+	参数同NewMsgQuePool
+*/
+func (r *MicroServiceRegistry) Resolve(name string, netType string, count int, balance BalanceType, typ MsgType, handler IMsgHandler, parser IParserFactory, opts *MsgQueOptions) *MsgQuePool {
+	pool := NewMsgQuePool(netType, nil, count, balance, typ, handler, parser, opts)
+	r.Watch(name, func(added, removed []*MicroService) {
+		for _, v := range removed {
+			pool.RemoveAddr(v.Addr)
+		}
+		for _, v := range added {
+			pool.AddAddr(v.Addr)
+		}
+	})
+	return pool
+}
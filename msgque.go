@@ -7,10 +7,12 @@
 package easynet
 
 import (
-	"easyutil"
+	"context"
+	"crypto/x509"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -57,6 +59,9 @@ type IMsgQue interface {
 	IsStop() bool
 	Available() bool
 	IsProxy() bool
+	PeerCertificates() []*x509.Certificate //tls连接对端的证书，非tls连接返回nil
+	PeerCred() *PeerCred                   //unix socket对端进程凭证，其他连接或不支持的系统返回nil
+	Subprotocol() string                   //ws连接协商的子协议，其他连接返回空
 
 	Send(m *Message) (re bool)
 	SendString(str string) (re bool)
@@ -65,12 +70,17 @@ type IMsgQue interface {
 	SendByteStrLn(str []byte) (re bool)
 	SendCallback(m *Message, c chan *Message) (re bool)
 	DelCallback(m *Message)
+	Call(ctx context.Context, m *Message) (*Message, error) //发送请求并等待回应，自动分配Index
+	CallAsync(m *Message, cb func(*Message, error))         //发送请求，收到回应、超时或连接关闭时回调，cb只会被调用一次
 	SetSendFast()
 	SetTimeout(t int)
 	SetCmdReadRaw()
 	GetTimeout() int
 	Reconnect(t int) //重连间隔  最小1s，此函数仅能连接关闭是调用
 
+	SetReconnectPolicy(policy *ReconnectPolicy) //设置自动重连策略，仅对StartConnect产生的消息队列有效
+	Close()                                     //关闭消息队列，不会自动重连
+
 	GetHandler() IMsgHandler
 
 	SetUser(user interface{})
@@ -83,7 +93,31 @@ type IMsgQue interface {
 	//服务器内部通讯时提升效率，比如战斗服发送消息到网关服，应该在连接建立时使用，cwriteCnt大于0表示重新设置cwrite缓存长度，内网一般发送较快，不用考虑
 	SetMultiplex(multiplex bool, cwriteCnt int) bool
 
+	SetCipher(c ICipher) //设置加密器，FlagEncrypt的消息使用该加密器加解密
+	GetCipher() ICipher  //未设置时如果开启了Config.AutoEncrypt返回全局加密器
+	KeyExchange() bool   //x25519密钥交换，完成后自动设置aes-gcm会话加密器，对端需要开启MsgQueOptions.KeyExchange
+
+	SetCompressor(c ICompressor) //设置压缩算法，仅影响发送，接收根据消息标记自动选择
+	GetCompressor() ICompressor
+
+	SetHeadCodec(codec IHeadCodec) //设置消息头编解码，需要在连接建立前设置
+	GetHeadCodec() IHeadCodec
+
+	SetHeartbeat(interval int) //设置心跳间隔 s，0表示关闭
+	RTT() int64                //最近一次心跳的往返时间 ms
+	LastPong() int64           //最近一次收到心跳回应的时间 ms
+
+	SetSendPolicy(policy SendPolicy, timeout int) //设置写入通道满时的处理策略，timeout仅对SendPolicyBlock有效 ms
+	SetHighWater(n int)                           //设置写入通道高水位，积压达到n时回调ISendHighWaterHandler.OnSendHighWater
+	DroppedCount() uint64                         //因写入通道满丢弃的消息数量
+	MalformedCount() uint64                       //收到的畸形帧数量
+	Pending() int                                 //写入通道中的消息和等待回应的请求数量
+
 	tryCallback(msg *Message) (re bool)
+	sendShared(m *Message, raw *Message) (re bool)
+	heartbeatTick(now int64)
+	reconnectAfter(ms int)
+	willReconnect() bool
 }
 
 type msgQue struct {
@@ -104,11 +138,115 @@ type msgQue struct {
 	available      bool
 	sendFast       bool
 	multiplex      bool
-	callback       map[uint32]chan *Message
+	callback       map[uint64]chan *Message
 	group          map[string]int
 	user           interface{}
 	callbackLock   sync.Mutex
 	realRemoteAddr string //当使用代理是，需要特殊设置客户端真实IP
+
+	packetSize  int                     //单个数据报最大长度，包含消息头，0表示不限制
+	noFragment  bool                    //不可靠传输，超长消息不拆分，直接发送失败
+	fragmentSeq uint32                  //发送的分片消息序号
+	fragment    map[uint64]*msgFragment //接收中的分片，key为tagKey，仅读取协程访问
+	fragmentLen uint32                  //接收中的分片总长度
+
+	cipher          ICipher             //加密器
+	exchange        *keyExchange        //进行中的密钥交换
+	kxOpts          *KeyExchangeOptions //密钥交换参数，nil表示未开启，MsgIdKeyExchange作为普通消息处理
+	encryptRequired bool                //密钥交换完成，拒绝未加密的消息
+
+	compressor ICompressor //压缩算法，nil表示使用Config.Compressor
+	headCodec  IHeadCodec  //消息头编解码，nil表示使用默认9字节消息头
+
+	callIndex uint32              //Call分配的Index
+	calls     map[uint64]*msgCall //等待回应的Call，key为tagKey
+
+	sendPolicy   SendPolicy //写入通道满时的处理策略
+	sendTimeout  int        //SendPolicyBlock的超时 ms，0表示一直等待
+	highWater    int        //写入通道积压达到该值时回调OnSendHighWater，0表示不回调
+	highWaterHit int32      //已触发高水位，积压降到一半以下后重置
+	dropped      uint64     //丢弃的消息数量
+	malformed    uint64     //畸形帧数量
+
+	heartbeat int32 //心跳间隔 s，0表示使用Config.HeartbeatInterval，小于0表示关闭
+	lastPing  int64 //最近一次发送ping的时间 ms
+	lastPong  int64 //最近一次收到pong的时间 ms，没有收到过时为0
+	pingStart int64 //开始发送心跳的时间 ms，收到pong之前用于判断超时
+	rtt       int64 //心跳往返时间 ms
+
+	reconnect         *ReconnectPolicy //重连策略
+	reconnectAttempts int              //连续重连次数，连接成功后清零
+	closing           int32            //调用了Close，不再重连
+	reconnectLock     sync.Mutex       //保护creconnect
+	creconnect        chan struct{}    //等待重连期间有效，Close时关闭以取消重连
+
+	resumeOpts *ResumeOptions //会话恢复参数，监听时对accept产生的消息队列生效
+	resumeWait bool           //开启会话恢复的accept消息队列，等待第一个消息
+	session    *resumeSession //拥有的会话
+	resumed    *resumeSession //作为新连接承载的其他消息队列的会话
+
+	proxyProtocol *ProxyProtocol //tcp监听解析PROXY protocol头
+	wsOpts        *WsOptions     //ws参数
+}
+
+//消息队列参数，用于StartServerWithOptions和StartConnectWithOptions，监听时对所有accept产生的消息队列生效
+type MsgQueOptions struct {
+	HeadCodec   IHeadCodec          //消息头编解码
+	SendPolicy  SendPolicy          //写入通道满时的处理策略
+	SendTimeout int                 //SendPolicyBlock的超时 ms
+	HighWater   int                 //写入通道高水位
+	Reconnect   *ReconnectPolicy    //重连策略，仅对连接有效
+	Resume      *ResumeOptions      //会话恢复，仅对tcp和ws有效，服务器和客户端需要同时开启
+	Proxy       *ProxyProtocol      //tcp和tls监听解析PROXY protocol头
+	Ws          *WsOptions          //ws参数
+	MaxPeers    int                 //udp监听的最大远端数量，0表示使用Config.UdpMaxPeers
+	KeyExchange *KeyExchangeOptions //开启密钥交换
+	Heartbeat   int                 //心跳间隔 s，监听时对accept产生的消息队列生效，0表示使用Config.HeartbeatInterval
+	Tls         *TlsConfig          //tls监听和连接的证书，nil时监听使用Config.SSLCrtPath和Config.SSLKeyPath，连接使用系统根证书
+}
+
+func (r *msgQue) setOptions(opts *MsgQueOptions) {
+	if opts == nil {
+		return
+	}
+	r.headCodec = opts.HeadCodec
+	r.sendPolicy = opts.SendPolicy
+	r.sendTimeout = opts.SendTimeout
+	r.highWater = opts.HighWater
+	r.reconnect = opts.Reconnect
+	r.resumeOpts = opts.Resume
+	r.proxyProtocol = opts.Proxy
+	r.wsOpts = opts.Ws
+	r.kxOpts = opts.KeyExchange
+	if opts.Heartbeat > 0 {
+		r.SetHeartbeat(opts.Heartbeat)
+	}
+	if opts.Resume != nil && r.connTyp == ConnTypeConn {
+		r.session = newResumeSession(r, opts.Resume)
+		r.session.owner = r.getMsgQue()
+	}
+	r.requireKeyExchange()
+}
+
+//accept产生的消息队列继承监听的设置
+func (r *msgQue) inherit(listener *msgQue) {
+	r.headCodec = listener.headCodec
+	r.sendPolicy = listener.sendPolicy
+	r.sendTimeout = listener.sendTimeout
+	r.highWater = listener.highWater
+	r.resumeOpts = listener.resumeOpts
+	r.resumeWait = listener.resumeOpts != nil
+	r.wsOpts = listener.wsOpts
+	r.kxOpts = listener.kxOpts
+	r.heartbeat = atomic.LoadInt32(&listener.heartbeat)
+	r.requireKeyExchange()
+}
+
+//获取外层的消息队列，用于回调
+func (r *msgQue) getMsgQue() IMsgQue {
+	msgqueMapSync.Lock()
+	defer msgqueMapSync.Unlock()
+	return msgqueMap[r.id]
 }
 
 func (r *msgQue) SetSendFast() {
@@ -174,6 +312,14 @@ func (r *msgQue) Reconnect(t int) {
 
 }
 
+func (r *msgQue) reconnectAfter(ms int) {
+
+}
+
+func (r *msgQue) PeerCertificates() []*x509.Certificate {
+	return nil
+}
+
 func (r *msgQue) IsProxy() bool {
 	return r.realRemoteAddr != ""
 }
@@ -182,27 +328,38 @@ func (r *msgQue) SetRealRemoteAddr(addr string) {
 	r.realRemoteAddr = addr
 }
 
+//停止检查和分组索引的修改都在callbackLock内，避免与baseStop中的ClearGroupId交错后残留在分组中
 func (r *msgQue) SetGroupId(group string) {
 	r.callbackLock.Lock()
+	defer r.callbackLock.Unlock()
 	if r.group == nil {
 		r.group = make(map[string]int)
 	}
+	_, ok := r.group[group]
 	r.group[group] = 0
-	r.callbackLock.Unlock()
+	if !ok && r.stop == 0 {
+		addGroupMember(group, r.id)
+	}
 }
 
 func (r *msgQue) DelGroupId(group string) {
 	r.callbackLock.Lock()
+	defer r.callbackLock.Unlock()
 	if r.group != nil {
-		delete(r.group, group)
+		if _, ok := r.group[group]; ok {
+			delete(r.group, group)
+			delGroupMember(group, r.id)
+		}
 	}
-	r.callbackLock.Unlock()
 }
 
 func (r *msgQue) ClearGroupId(group string) {
 	r.callbackLock.Lock()
+	defer r.callbackLock.Unlock()
+	for g := range r.group {
+		delGroupMember(g, r.id)
+	}
 	r.group = nil
-	r.callbackLock.Unlock()
 }
 
 func (r *msgQue) IsInGroup(group string) bool {
@@ -228,38 +385,178 @@ func (r *msgQue) Send(m *Message) (re bool) {
 	if m == nil {
 		return
 	}
+	if r.session != nil && m.Head != nil {
+		return r.session.send(m)
+	}
+	return r.sendDirect(m)
+}
+
+//不经过会话直接发送
+func (r *msgQue) sendDirect(m *Message) (re bool) {
 	defer func() {
 		if err := recover(); err != nil {
 			re = false
 		}
 	}()
-	if Config.AutoEncrypt && m.Head != nil && (m.Head.Flags&FlagEncrypt) == 0 {
-		m.Head.Flags |= FlagEncrypt
-		m.Data = easyutil.Encrypt(m.Data)
-		m.Head.Len = uint32(len(m.Data))
+	encrypt := m.Head != nil && len(m.Data) > 0 && (m.Head.Flags&FlagEncrypt) == 0
+	if encrypt && r.exchange != nil && r.holdForKeyExchange(m) {
+		return true
 	}
+	//先压缩后加密，密文无法压缩
 	if Config.AutoCompressLen > 0 && m.Head != nil && m.Head.Len >= Config.AutoCompressLen && (m.Head.Flags&FlagCompress) == 0 {
-		m.Head.Flags |= FlagCompress
-		m.Data = easyutil.GZipCompress(m.Data)
-		m.Head.Len = uint32(len(m.Data))
+		if err := r.compress(m); err != nil {
+			LogError("msgque compress failed msgque:%v id:%v err:%v", r.id, m.Head.Id, err)
+			return false
+		}
+	}
+	if encrypt {
+		if c := r.GetCipher(); c != nil {
+			data, err := c.Encrypt(m.Data)
+			if err != nil {
+				LogError("msgque encrypt failed msgque:%v id:%v err:%v", r.id, m.Head.Id, err)
+				return false
+			}
+			m.Head.Flags |= FlagEncrypt
+			m.Data = data
+			m.Head.Len = uint32(len(m.Data))
+		}
 	}
-	select {
-	case r.cwrite <- m:
-	default:
-		LogWarn("[msgque]obstruct,write channel full msgque:%v", r.id)
-		r.cwrite <- m
+	if m.Head != nil && uint32(len(m.Data)) > r.getFragmentSize() {
+		return r.sendFragment(m)
+	}
+	return r.pushWrite(m)
+}
+
+//单个分片最大长度，数据报长度有限制时按消息头编码器的消息头长度计算
+func (r *msgQue) getFragmentSize() uint32 {
+	if r.packetSize > 0 {
+		if size := r.packetSize - r.GetHeadCodec().MaxHeadSize(); size > fragmentHeadSize && uint32(size) < MaxMsgDataSize {
+			return uint32(size)
+		}
 	}
+	return MaxMsgDataSize
+}
 
+//超长消息拆分为多个分片发送，所有分片都带有FlagContinue，分片共用原消息的Tag
+//分片数据前有分片头，接收方按分片头检查丢失、乱序和重复，不完整的分片消息会被丢弃
+//同一Tag的超长消息不能在多个协程中同时发送
+func (r *msgQue) sendFragment(m *Message) bool {
+	if r.noFragment {
+		LogError("[msgque]msg too long for unreliable transport msgque:%v id:%v len:%v", r.id, m.Head.Id, len(m.Data))
+		return false
+	}
+	size := int(r.getFragmentSize()) - fragmentHeadSize
+	total := (len(m.Data) + size - 1) / size
+	if uint32(len(m.Data)) > MaxReassembleSize || total > 0xFFFF {
+		LogError("[msgque]msg too long msgque:%v id:%v len:%v", r.id, m.Head.Id, len(m.Data))
+		return false
+	}
+	serial := atomic.AddUint32(&r.fragmentSeq, 1)
+	for i := 0; i < total; i++ {
+		pos, end := i*size, (i+1)*size
+		if end > len(m.Data) {
+			end = len(m.Data)
+		}
+		data := make([]byte, fragmentHeadSize+end-pos)
+		msgHeadByteOrder.PutUint32(data, serial)
+		msgHeadByteOrder.PutUint16(data[4:], uint16(i))
+		msgHeadByteOrder.PutUint16(data[6:], uint16(total))
+		copy(data[fragmentHeadSize:], m.Data[pos:end])
+		if !r.pushWrite(&Message{
+			Head: &MessageHead{
+				Len:   uint32(len(data)),
+				Id:    m.Head.Id,
+				Index: m.Head.Index,
+				Flags: m.Head.Flags | FlagContinue,
+				IdExt: m.Head.IdExt,
+			},
+			Data: data,
+		}) {
+			return false
+		}
+	}
 	return true
 }
 
+//重组分片，返回nil表示分片未接收完成
+func (r *msgQue) reassemble(msg *Message) (*Message, bool) {
+	tag := msg.tagKey()
+	f := r.fragment[tag]
+	if msg.Head.Flags&FlagContinue == 0 {
+		//同一Tag的普通消息，之前的分片不会再完整
+		if f != nil {
+			LogWarn("[msgque]drop incomplete fragments msgque:%v id:%v got:%v total:%v", r.id, msg.Head.Id, len(f.chunks), f.total)
+			r.dropFragment(tag)
+		}
+		return msg, true
+	}
+	if len(msg.Data) < fragmentHeadSize {
+		LogError("[msgque]fragment too short msgque:%v id:%v len:%v", r.id, msg.Head.Id, len(msg.Data))
+		return nil, false
+	}
+	serial := msgHeadByteOrder.Uint32(msg.Data)
+	index := msgHeadByteOrder.Uint16(msg.Data[4:])
+	total := msgHeadByteOrder.Uint16(msg.Data[6:])
+	if index >= total {
+		LogError("[msgque]bad fragment msgque:%v id:%v index:%v total:%v", r.id, msg.Head.Id, index, total)
+		return nil, false
+	}
+	if f != nil && (f.serial != serial || f.total != total) {
+		LogWarn("[msgque]drop incomplete fragments msgque:%v id:%v got:%v total:%v", r.id, msg.Head.Id, len(f.chunks), f.total)
+		r.dropFragment(tag)
+		f = nil
+	}
+	if r.fragmentLen+uint32(len(msg.Data)) > MaxReassembleSize {
+		LogError("[msgque]reassemble msg too long msgque:%v id:%v len:%v", r.id, msg.Head.Id, r.fragmentLen+uint32(len(msg.Data)))
+		return nil, false
+	}
+	if f == nil {
+		f = &msgFragment{serial: serial, total: total, chunks: map[uint16][]byte{}}
+		if r.fragment == nil {
+			r.fragment = map[uint64]*msgFragment{}
+		}
+		r.fragment[tag] = f
+	}
+	if _, ok := f.chunks[index]; ok {
+		msg.Release() //重复的分片
+		return nil, true
+	}
+	f.chunks[index] = append([]byte(nil), msg.Data[fragmentHeadSize:]...)
+	f.size += uint32(len(msg.Data))
+	r.fragmentLen += uint32(len(msg.Data))
+	msg.Release() //数据已复制
+	if len(f.chunks) < int(total) {
+		return nil, true
+	}
+	r.dropFragment(tag)
+	data := make([]byte, 0, f.size)
+	for i := uint16(0); i < total; i++ {
+		data = append(data, f.chunks[i]...)
+	}
+	msg.buf = nil
+	msg.Data = data
+	msg.Head.Len = uint32(len(data))
+	msg.Head.Flags &^= FlagContinue
+	return msg, true
+}
+
+func (r *msgQue) dropFragment(tag uint64) {
+	if f, ok := r.fragment[tag]; ok {
+		r.fragmentLen -= f.size
+		delete(r.fragment, tag)
+	}
+	if len(r.fragment) == 0 {
+		r.fragment = nil
+	}
+}
+
 func (r *msgQue) SendCallback(m *Message, c chan *Message) (re bool) {
 	if c == nil || cap(c) < 1 {
 		LogError("try send callback but chan is null or no buffer")
 		return
 	}
 	if r.Send(m) {
-		r.setCallback(m.Tag(), c)
+		r.setCallback(m.tagKey(), c)
 	} else {
 		c <- nil
 		return
@@ -272,7 +569,7 @@ func (r *msgQue) DelCallback(m *Message) {
 		return
 	}
 	r.callbackLock.Lock()
-	delete(r.callback, m.Tag())
+	delete(r.callback, m.tagKey())
 	r.callbackLock.Unlock()
 }
 
@@ -293,6 +590,9 @@ func (r *msgQue) SendByteStrLn(str []byte) (re bool) {
 }
 
 func (r *msgQue) tryCallback(msg *Message) (re bool) {
+	if r.tryCall(msg) {
+		return true
+	}
 	if r.callback == nil {
 		return false
 	}
@@ -304,7 +604,7 @@ func (r *msgQue) tryCallback(msg *Message) (re bool) {
 	}()
 	r.callbackLock.Lock()
 	if r.callback != nil {
-		tag := msg.Tag()
+		tag := msg.tagKey()
 		if c, ok := r.callback[tag]; ok {
 			delete(r.callback, tag)
 			c <- msg
@@ -314,7 +614,7 @@ func (r *msgQue) tryCallback(msg *Message) (re bool) {
 	return
 }
 
-func (r *msgQue) setCallback(tag uint32, c chan *Message) {
+func (r *msgQue) setCallback(tag uint64, c chan *Message) {
 	defer func() {
 		if err := recover(); err != nil {
 
@@ -325,7 +625,7 @@ func (r *msgQue) setCallback(tag uint32, c chan *Message) {
 
 	r.callbackLock.Lock()
 	if r.callback == nil {
-		r.callback = make(map[uint32]chan *Message)
+		r.callback = make(map[uint64]chan *Message)
 	}
 	oc, ok := r.callback[tag]
 	if ok { //可能已经关闭
@@ -337,6 +637,8 @@ func (r *msgQue) baseStop() {
 	if r.cwrite != nil {
 		close(r.cwrite)
 	}
+	r.stopCalls()
+	r.ClearGroupId("")
 
 	for k, v := range r.callback {
 		Try(func() {
@@ -352,6 +654,44 @@ func (r *msgQue) baseStop() {
 	LogInfo("[msgque] close msgque id:%d", r.id)
 }
 func (r *msgQue) processMsg(msgque IMsgQue, msg *Message) bool {
+	if msg.Head != nil && (msg.Head.Flags&FlagContinue > 0 || r.fragment != nil) {
+		var ok bool
+		if msg, ok = r.reassemble(msg); !ok {
+			return false
+		} else if msg == nil {
+			return true
+		}
+	}
+	//保留的消息ID只在开启对应功能时拦截，否则作为普通消息处理
+	if msg.Head != nil && msg.Head.Id == MsgIdKeyExchange && r.kxOpts != nil {
+		return r.onKeyExchange(msg)
+	}
+	if msg.Head != nil && msg.Head.Id == MsgIdHeartbeat && r.getHeartbeat() > 0 {
+		return r.onHeartbeat(msg)
+	}
+	if r.isKeyExchangePending() {
+		LogError("msgque recv msg before key exchange msgque:%v id:%v", r.id, msg.Id())
+		return false
+	}
+	if msg.Head != nil && msg.Head.Id == MsgIdResume && (r.resumeOpts != nil || r.session != nil) {
+		return r.onResume(msgque, msg)
+	}
+	if r.resumeWait {
+		//未请求会话恢复的连接
+		r.resumeWait = false
+		if !r.handler.OnNewMsgQue(msgque) {
+			return false
+		}
+		r.init = true
+	}
+	if s := r.resumeSession(); s != nil {
+		if s.owner != nil {
+			msgque = s.owner
+		}
+		if msg.Head != nil && msg.Head.Flags&FlagResume > 0 {
+			s.onRecv()
+		}
+	}
 	if r.multiplex {
 		Go(func() {
 			r.processMsgTrue(msgque, msg)
@@ -362,21 +702,31 @@ func (r *msgQue) processMsg(msgque IMsgQue, msg *Message) bool {
 	return true
 }
 func (r *msgQue) processMsgTrue(msgque IMsgQue, msg *Message) bool {
-	if msg.Head != nil && msg.Head.Flags&FlagCompress > 0 && msg.Data != nil {
-		data, err := easyutil.GZipUnCompress(msg.Data)
+	if msg.Head != nil && msg.Head.Flags&FlagEncrypt == 0 && len(msg.Data) > 0 && r.isEncryptRequired() {
+		LogError("msgque recv unencrypted msg after key exchange msgque:%v id:%v", msgque.Id(), msg.Head.Id)
+		return false
+	}
+	if msg.Head != nil && msg.Head.Flags&FlagEncrypt > 0 && msg.Data != nil {
+		c := r.GetCipher()
+		if c == nil {
+			LogError("msgque decrypt failed no cipher msgque:%v id:%v", msgque.Id(), msg.Head.Id)
+			return false
+		}
+		data, err := c.Decrypt(msg.Data)
 		if err != nil {
-			LogError("msgque uncompress failed msgque:%v id:%v len:%v err:%v", msgque.Id(), msg.Head.Id, msg.Head.Len, err)
+			LogError("msgque decrypt failed msgque:%v id:%v len:%v err:%v", msgque.Id(), msg.Head.Id, msg.Head.Len, err)
 			return false
 		}
 		msg.Data = data
-		msg.Head.Flags -= FlagCompress
-		msg.Head.Len = uint32(len(msg.Data))
-	}
-	if msg.Head != nil && msg.Head.Flags&FlagEncrypt > 0 && msg.Data != nil {
-		msg.Data = easyutil.Decrypt(msg.Data)
 		msg.Head.Flags -= FlagEncrypt
 		msg.Head.Len = uint32(len(msg.Data))
 	}
+	if msg.Head != nil && msg.Head.Flags&FlagCompress > 0 && msg.Data != nil {
+		if err := r.unCompress(msg); err != nil {
+			LogError("msgque uncompress failed msgque:%v id:%v len:%v err:%v", msgque.Id(), msg.Head.Id, msg.Head.Len, err)
+			return false
+		}
+	}
 	if r.parser != nil {
 		mp, err := r.parser.ParseC2S(msg)
 		if err == nil {
@@ -409,15 +759,34 @@ func (r *msgQue) processMsgTrue(msgque IMsgQue, msg *Message) bool {
 	if f == nil {
 		f = r.handler.OnProcessMsg
 	}
-	return f(msgque, msg)
+	re := f(msgque, msg)
+	msg.Release()
+	return re
 }
 
 func StartServer(addr string, typ MsgType, handler IMsgHandler, parser IParserFactory) error {
+	return StartServerWithOptions(addr, typ, handler, parser, nil)
+}
+
+func StartServerWithOptions(addr string, typ MsgType, handler IMsgHandler, parser IParserFactory, opts *MsgQueOptions) error {
+	if Config.HeartbeatInterval > 0 {
+		startHeartbeat()
+	}
+	if opts != nil && opts.Proxy != nil {
+		if err := opts.Proxy.init(); err != nil {
+			LogError("listen on %s failed, proxy protocol trusted err:%v", addr, err)
+			return err
+		}
+	}
 	addrs := strings.Split(addr, "://")
+	if addrs[0] == "tls" {
+		return startTlsServer(addr, typ, handler, parser, opts)
+	}
 	if addrs[0] == "tcp" || addrs[0] == "all" {
 		listen, err := net.Listen("tcp", addrs[1])
 		if err == nil {
 			msgque := newTcpListen(listen, typ, handler, parser, addr)
+			msgque.setOptions(opts)
 			Go(func() {
 				LogDebug("process listen for tcp msgque:%d", msgque.id)
 				msgque.listen()
@@ -428,6 +797,29 @@ func StartServer(addr string, typ MsgType, handler IMsgHandler, parser IParserFa
 			return err
 		}
 	}
+	if addrs[0] == "udp" || addrs[0] == "rudp" {
+		laddr, err := net.ResolveUDPAddr("udp", addrs[1])
+		var conn *net.UDPConn
+		if err == nil {
+			conn, err = net.ListenUDP("udp", laddr)
+		}
+		if err == nil {
+			msgque := newUdpListen(conn, typ, handler, parser, addr)
+			msgque.setReliable(addrs[0] == "rudp")
+			msgque.setOptions(opts)
+			if opts != nil {
+				msgque.maxPeers = opts.MaxPeers
+			}
+			Go(func() {
+				LogDebug("process listen for udp msgque:%d", msgque.id)
+				msgque.listen()
+				LogDebug("process listen end for udp msgque:%d", msgque.id)
+			})
+		} else {
+			LogError("listen on %s failed, errstr:%s", addr, err)
+			return err
+		}
+	}
 	if addrs[0] == "ws" || addrs[0] == "wss" {
 		naddr := strings.SplitN(addrs[1], "/", 2)
 		url := "/"
@@ -437,22 +829,42 @@ func StartServer(addr string, typ MsgType, handler IMsgHandler, parser IParserFa
 		if addrs[0] == "wss" {
 			Config.EnableWss = true
 		}
-		msgque := newWsListen(naddr[0], url, typ, handler, parser)
-		Go(func() {
-			LogDebug("process listen for ws msgque:%d", msgque.id)
-			msgque.listen()
-			LogDebug("process listen end for ws msgque:%d", msgque.id)
-		})
+		return startWsServer(naddr[0], url, typ, handler, parser, opts)
+	}
+	if addrs[0] == "unix" {
+		return startUnixServer(addr, typ, handler, parser, opts)
 	}
 	return nil
 }
 
 func StartConnect(netType string, addr string, typ MsgType, handler IMsgHandler, parser IParserFactory, user interface{}) IMsgQue {
+	return StartConnectWithOptions(netType, addr, typ, handler, parser, user, nil)
+}
+
+func StartConnectWithOptions(netType string, addr string, typ MsgType, handler IMsgHandler, parser IParserFactory, user interface{}, opts *MsgQueOptions) IMsgQue {
+	if Config.HeartbeatInterval > 0 {
+		startHeartbeat()
+	}
 	var msgque IMsgQue
-	if netType == "ws" || netType == "wss" {
-		msgque = newWsConn(addr, nil, typ, handler, parser, user)
+	if netType == "tls" {
+		return startTlsConnect(addr, typ, handler, parser, user, opts)
+	} else if netType == "ws" || netType == "wss" {
+		wsMsgque := newWsConn(addr, nil, typ, handler, parser, user)
+		wsMsgque.setOptions(opts)
+		msgque = wsMsgque
+	} else if netType == "udp" || netType == "rudp" {
+		udpMsgque := newUdpConn("udp", addr, typ, handler, parser, user)
+		udpMsgque.setReliable(netType == "rudp")
+		udpMsgque.setOptions(opts)
+		msgque = udpMsgque
+	} else if netType == "unix" {
+		tcpMsgque := newTcpConn(netType, unixPath(addr), nil, typ, handler, parser, user)
+		tcpMsgque.setOptions(opts)
+		msgque = tcpMsgque
 	} else {
-		msgque = newTcpConn(netType, addr, nil, typ, handler, parser, user)
+		tcpMsgque := newTcpConn(netType, addr, nil, typ, handler, parser, user)
+		tcpMsgque.setOptions(opts)
+		msgque = tcpMsgque
 	}
 	if handler.OnNewMsgQue(msgque) {
 		msgque.Reconnect(0)
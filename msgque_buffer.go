@@ -0,0 +1,158 @@
+/*
+@Time       : 2022/7/8
+@Author     : wuqiusheng
+@File       : msgque_buffer.go
+@Description: 按长度分级的缓冲区池，Config.MsgBufferPool开启后tcp和ws的读写使用
+			接收到的消息在处理函数返回后释放，处理函数需要保留数据时应复制
+			通过IMsgPost投递或作为Call回应返回的消息，由接收者在使用完后调用Message.Release，不调用只是不能复用
+			发送时写入通道持有消息的引用，写入后释放，所以处理函数可以直接发送收到的消息
+			Config.MsgBufferDebug开启后释放的缓冲区会被填充，复用时检查是否被修改，并检查重复释放
+*/
+package easynet
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	minBufferShift = 6  //最小64字节
+	maxBufferShift = 20 //最大1M，更大的缓冲区不复用
+	bufferPoison   = 0xDD
+)
+
+var (
+	bufferPools    [maxBufferShift - minBufferShift + 1]sync.Pool
+	bufferReleased sync.Map //调试模式下已释放的缓冲区
+)
+
+func bufferClass(size int) int {
+	for i := 0; i <= maxBufferShift-minBufferShift; i++ {
+		if size <= 1<<(i+minBufferShift) {
+			return i
+		}
+	}
+	return -1
+}
+
+//获取长度为size的缓冲区
+func GetBuffer(size int) []byte {
+	class := bufferClass(size)
+	if class < 0 {
+		return make([]byte, size)
+	}
+	if v := bufferPools[class].Get(); v != nil {
+		buf := *(v.(*[]byte))
+		if Config.MsgBufferDebug {
+			checkBuffer(buf)
+		}
+		return buf[:size]
+	}
+	return make([]byte, size, 1<<(class+minBufferShift))
+}
+
+//归还GetBuffer获取的缓冲区，归还后不能再使用
+func PutBuffer(buf []byte) {
+	class := bufferClass(cap(buf))
+	if class < 0 || cap(buf) != 1<<(class+minBufferShift) {
+		return
+	}
+	buf = buf[:cap(buf)]
+	if Config.MsgBufferDebug {
+		if _, ok := bufferReleased.LoadOrStore(&buf[0], true); ok {
+			LogError("[buffer]buffer released twice size:%v", cap(buf))
+			LogStack()
+			return
+		}
+		for i := range buf {
+			buf[i] = bufferPoison
+		}
+	}
+	bufferPools[class].Put(&buf)
+}
+
+func checkBuffer(buf []byte) {
+	bufferReleased.Delete(&buf[0])
+	for _, b := range buf {
+		if b != bufferPoison {
+			LogError("[buffer]buffer modified after release size:%v", cap(buf))
+			return
+		}
+	}
+}
+
+//读取全部数据到缓冲区，size为初始长度
+func readBuffer(reader io.Reader, size int) ([]byte, error) {
+	buf := GetBuffer(size)[:0]
+	for {
+		if len(buf) == cap(buf) {
+			nbuf := GetBuffer(cap(buf) * 2)[:len(buf)]
+			copy(nbuf, buf)
+			PutBuffer(buf)
+			buf = nbuf
+		}
+		n, err := reader.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		} else if err != nil {
+			PutBuffer(buf)
+			return nil, err
+		}
+	}
+}
+
+//消息数据的缓冲区，引用计数为0时归还
+type msgBuffer struct {
+	data []byte
+	ref  int32
+}
+
+func newMsgBuffer(data []byte) *msgBuffer {
+	return &msgBuffer{data: data, ref: 1}
+}
+
+func (r *msgBuffer) retain() {
+	atomic.AddInt32(&r.ref, 1)
+}
+
+func (r *msgBuffer) release() {
+	ref := atomic.AddInt32(&r.ref, -1)
+	if ref == 0 {
+		PutBuffer(r.data)
+	} else if ref < 0 && Config.MsgBufferDebug {
+		LogError("[buffer]msg released twice size:%v", cap(r.data))
+		LogStack()
+	}
+}
+
+//释放对消息数据的引用，释放后不能再使用Data，未使用缓冲区池的消息调用无影响
+func (r *Message) Release() {
+	if r.buf != nil {
+		r.buf.release()
+	}
+}
+
+func (r *Message) retain() {
+	if r.buf != nil {
+		r.buf.retain()
+	}
+}
+
+//使用缓冲区编码消息，返回的缓冲区在写入后使用PutBuffer归还
+func (r *msgQue) encodeMsg(m *Message) ([]byte, bool) {
+	if !Config.MsgBufferPool || m.Head == nil {
+		return r.msgBytes(m), false
+	}
+	codec := r.GetHeadCodec()
+	buf := GetBuffer(codec.MaxHeadSize() + int(m.Head.Len))
+	data := codec.EncodeHead(buf[:0], m.Head, m.Data)
+	data = append(data, m.Data[:m.Head.Len]...)
+	if &data[0] != &buf[0] {
+		//消息头超过MaxHeadSize，缓冲区已重新分配
+		PutBuffer(buf)
+		return data, false
+	}
+	return data, true
+}
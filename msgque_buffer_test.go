@@ -0,0 +1,94 @@
+package easynet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+//直接发送收到的消息，依赖写入通道持有的引用
+type testForwardHandler struct {
+	DefMsgHandler
+}
+
+func (r *testForwardHandler) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	msgque.Send(msg)
+	return true
+}
+
+//开启缓冲区调试，所有归还到池中的缓冲区都被填充，避免之后的检查误报
+func testBufferDebug() func() {
+	old := Config.MsgBufferDebug
+	Config.MsgBufferDebug = true
+	return func() { Config.MsgBufferDebug = old }
+}
+
+func TestGetBuffer(t *testing.T) {
+	defer testBufferDebug()()
+	cases := []struct{ size, cap int }{{1, 64}, {64, 64}, {65, 128}, {1000, 1024}, {1 << 20, 1 << 20}, {1<<20 + 1, 1<<20 + 1}}
+	for _, c := range cases {
+		buf := GetBuffer(c.size)
+		if len(buf) != c.size || cap(buf) != c.cap {
+			t.Fatalf("size:%v len:%v cap:%v", c.size, len(buf), cap(buf))
+		}
+		PutBuffer(buf)
+	}
+}
+
+//引用计数为0时才归还缓冲区，调试模式下归还的缓冲区被填充
+func TestMsgBufferRef(t *testing.T) {
+	defer testBufferDebug()()
+	data := GetBuffer(100)
+	copy(data, "hello")
+	m := &Message{Data: data, buf: newMsgBuffer(data)}
+	m.retain()
+	m.Release()
+	if string(data[:5]) != "hello" {
+		t.Fatal("buffer released while referenced")
+	}
+	m.Release()
+	if data[0] != bufferPoison {
+		t.Fatal("buffer not released")
+	}
+}
+
+func TestReadBuffer(t *testing.T) {
+	defer testBufferDebug()()
+	src := bytes.Repeat([]byte("0123456789"), 1000)
+	buf, err := readBuffer(bytes.NewReader(src), 64)
+	if err != nil || !bytes.Equal(buf, src) {
+		t.Fatalf("len:%v err:%v", len(buf), err)
+	}
+	PutBuffer(buf)
+}
+
+//开启缓冲区池后收到的消息直接转发，数据在写入前不被复用
+func TestBufferPoolTcp(t *testing.T) {
+	defer testBufferDebug()()
+	old := Config.MsgBufferPool
+	Config.MsgBufferPool = true
+	defer func() { Config.MsgBufferPool = old }()
+	if err := StartServer("tcp://127.0.0.1:29141", MsgTypeMsg, &testForwardHandler{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	h := &testRecvHandler{got: make(chan *Message, 100)}
+	c := StartConnect("tcp", "127.0.0.1:29141", MsgTypeMsg, h, nil, nil)
+	defer c.Stop()
+	var sent [][]byte
+	for i := 0; i < 50; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 1+i*97)
+		sent = append(sent, data)
+		c.Send(NewMsg(uint16(i), 0, data))
+	}
+	for i, data := range sent {
+		select {
+		case m := <-h.got:
+			if m.Id() != uint16(i) || !bytes.Equal(m.Data, data) {
+				t.Fatalf("msg:%v id:%v len:%v", i, m.Id(), len(m.Data))
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout", i)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+@Time       : 2022/7/4
+@Author     : wuqiusheng
+@File       : msgque_call.go
+@Description: 基于消息Tag的请求回应，Index由消息队列自动分配，32位消息ID的高16位也参与匹配
+			对端回应时需要保持请求的Id和Index，可使用CopyTag
+			连接关闭或重连时，所有等待中的请求返回ErrNetClosed
+*/
+package easynet
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type msgCall struct {
+	tag  uint64
+	cb   func(*Message, error)
+	done int32
+}
+
+func (r *msgCall) finish(msg *Message, err error) {
+	if atomic.CompareAndSwapInt32(&r.done, 0, 1) {
+		r.cb(msg, err)
+	}
+}
+
+type callResult struct {
+	msg *Message
+	err error
+}
+
+func (r *msgQue) Call(ctx context.Context, m *Message) (*Message, error) {
+	timeout := 0
+	if _, ok := ctx.Deadline(); !ok {
+		timeout = Config.CallTimeout
+	}
+	c := make(chan callResult, 1)
+	call, err := r.addCall(m, func(msg *Message, err error) {
+		c <- callResult{msg, err}
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case re := <-c:
+		return re.msg, re.err
+	case <-ctx.Done():
+		if !r.delCall(call) { //回应已经到达
+			re := <-c
+			return re.msg, re.err
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrNetTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+//cb在读取协程或定时器协程中调用，不应阻塞，请求发送失败时在当前协程调用
+func (r *msgQue) CallAsync(m *Message, cb func(*Message, error)) {
+	if _, err := r.addCall(m, cb, Config.CallTimeout); err != nil {
+		cb(nil, err)
+	}
+}
+
+//分配Index并发送请求，timeout大于0时超时返回ErrNetTimeout
+func (r *msgQue) addCall(m *Message, cb func(*Message, error), timeout int) (*msgCall, error) {
+	if r.msgTyp != MsgTypeMsg || m.Head == nil {
+		return nil, ErrProtoPack
+	}
+	call := &msgCall{cb: cb}
+	r.callbackLock.Lock()
+	if r.stop == 1 {
+		r.callbackLock.Unlock()
+		return nil, ErrNetClosed
+	}
+	if r.calls == nil {
+		r.calls = map[uint64]*msgCall{}
+	}
+	for i := 0; i < 0xFFFF; i++ {
+		index := uint16(atomic.AddUint32(&r.callIndex, 1))
+		if index == 0 {
+			continue
+		}
+		tag := uint64(m.Head.IdExt)<<32 | uint64(Tag(m.Head.Id, index))
+		if _, ok := r.calls[tag]; ok {
+			continue
+		}
+		if _, ok := r.callback[tag]; ok {
+			continue
+		}
+		m.Head.Index = index
+		call.tag = tag
+		break
+	}
+	if call.tag == 0 {
+		r.callbackLock.Unlock()
+		return nil, ErrCallBusy
+	}
+	r.calls[call.tag] = call
+	r.callbackLock.Unlock()
+
+	if !r.Send(m) {
+		if r.delCall(call) {
+			return nil, ErrNetUnreachable
+		}
+	}
+	if timeout > 0 {
+		SetTimeout(timeout, func(...interface{}) int {
+			if r.delCall(call) {
+				call.finish(nil, ErrNetTimeout)
+			}
+			return 0
+		})
+	}
+	return call, nil
+}
+
+//移除等待中的请求，返回false表示已被回应、超时或关闭处理
+func (r *msgQue) delCall(call *msgCall) bool {
+	r.callbackLock.Lock()
+	defer r.callbackLock.Unlock()
+	if c, ok := r.calls[call.tag]; ok && c == call {
+		delete(r.calls, call.tag)
+		return true
+	}
+	return false
+}
+
+func (r *msgQue) tryCall(msg *Message) bool {
+	if msg.Head == nil {
+		return false
+	}
+	tag := msg.Head.tagKey()
+	r.callbackLock.Lock()
+	call, ok := r.calls[tag]
+	if ok {
+		delete(r.calls, tag)
+	}
+	r.callbackLock.Unlock()
+	if !ok {
+		return false
+	}
+	call.finish(msg, nil)
+	return true
+}
+
+func (r *msgQue) stopCalls() {
+	r.callbackLock.Lock()
+	calls := r.calls
+	r.calls = nil
+	r.callbackLock.Unlock()
+	for _, call := range calls {
+		call.finish(nil, ErrNetClosed)
+	}
+}
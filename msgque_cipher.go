@@ -0,0 +1,361 @@
+/*
+@Time       : 2022/6/28
+@Author     : wuqiusheng
+@File       : msgque_cipher.go
+@Description: 消息加密，每个消息队列可单独设置加密器
+			内置x25519密钥交换，交换完成后使用会话密钥进行aes-gcm加密，并拒绝未加密的消息
+			密钥交换需要通过MsgQueOptions.KeyExchange开启，设置Psk时双方使用预共享密钥认证，防止中间人
+			设置Required时交换完成前收到其他消息关闭连接，连接端连接成功后自动发起交换
+			重连后重新交换，断线期间使用旧密钥加密的消息在新的交换完成后重新加密发出
+			FlagEncrypt表示消息使用当前消息队列的加密器加密
+*/
+package easynet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"easyutil"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	MsgIdKeyExchange uint16 = 0xFFFF //密钥交换消息ID，保留，开启密钥交换时不会交给消息处理器
+)
+
+var keyExchangeInfo = []byte("easynet key exchange")
+
+//密钥交换参数
+type KeyExchangeOptions struct {
+	Psk      []byte //预共享密钥，参与会话密钥的生成，双方不一致时无法解密消息并关闭连接，为空时不认证对端
+	Required bool   //要求密钥交换，交换完成前收到其他消息时关闭连接
+}
+
+type ICipher interface {
+	Encrypt(data []byte) ([]byte, error)
+	Decrypt(data []byte) ([]byte, error)
+}
+
+//兼容Config.AutoEncrypt的全局加密，所有连接使用相同的算法
+type EasyCipher struct{}
+
+func (r *EasyCipher) Encrypt(data []byte) ([]byte, error) {
+	return easyutil.Encrypt(data), nil
+}
+
+func (r *EasyCipher) Decrypt(data []byte) ([]byte, error) {
+	return easyutil.Decrypt(data), nil
+}
+
+var defCipher ICipher = &EasyCipher{}
+
+//aes-gcm加密，数据格式 nonce + 密文
+type AesGcmCipher struct {
+	aead cipher.AEAD
+}
+
+func (r *AesGcmCipher) Encrypt(data []byte) ([]byte, error) {
+	nonceSize := r.aead.NonceSize()
+	out := make([]byte, nonceSize, nonceSize+len(data)+r.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		return nil, err
+	}
+	return r.aead.Seal(out, out, data, nil), nil
+}
+
+func (r *AesGcmCipher) Decrypt(data []byte) ([]byte, error) {
+	nonceSize := r.aead.NonceSize()
+	if len(data) < nonceSize+r.aead.Overhead() {
+		return nil, ErrMsgLenTooShort
+	}
+	return r.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+}
+
+//key长度16，24，32分别对应aes-128，aes-192，aes-256
+func NewAesGcmCipher(key []byte) (*AesGcmCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AesGcmCipher{aead: aead}, nil
+}
+
+//x25519密钥交换状态
+type keyExchange struct {
+	priv    []byte
+	pub     []byte
+	started bool       //已发送公钥
+	pending []*Message //交换完成前发送的消息
+}
+
+func newKeyExchange() (*keyExchange, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &keyExchange{priv: priv, pub: pub}, nil
+}
+
+//根据对端公钥生成会话加密器，双方公钥按字节序排列后作为盐，保证两端得到相同的密钥
+func (r *keyExchange) cipher(peerPub []byte, psk []byte) (ICipher, error) {
+	secret, err := curve25519.X25519(r.priv, peerPub)
+	if err != nil {
+		return nil, err
+	}
+	secret = append(secret, psk...)
+	salt := make([]byte, 0, len(r.pub)+len(peerPub))
+	if bytes.Compare(r.pub, peerPub) < 0 {
+		salt = append(append(salt, r.pub...), peerPub...)
+	} else {
+		salt = append(append(salt, peerPub...), r.pub...)
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, keyExchangeInfo), key); err != nil {
+		return nil, err
+	}
+	return NewAesGcmCipher(key)
+}
+
+func (r *msgQue) SetCipher(c ICipher) {
+	r.callbackLock.Lock()
+	r.cipher = c
+	r.callbackLock.Unlock()
+}
+
+func (r *msgQue) GetCipher() ICipher {
+	r.callbackLock.Lock()
+	c := r.cipher
+	r.callbackLock.Unlock()
+	if c == nil && Config.AutoEncrypt {
+		return defCipher
+	}
+	return c
+}
+
+//开始密钥交换，应在OnNewMsgQue或OnConnectComplete中调用，只需一端调用，另一端开启MsgQueOptions.KeyExchange后收到自动回应
+//交换完成前发送的消息会被缓存，完成后加密发出，消息队列已关闭时返回false
+func (r *msgQue) KeyExchange() bool {
+	if r.msgTyp != MsgTypeMsg {
+		return false
+	}
+	r.callbackLock.Lock()
+	if r.kxOpts == nil {
+		r.kxOpts = &KeyExchangeOptions{}
+	}
+	r.callbackLock.Unlock()
+	return r.startKeyExchange()
+}
+
+//发送公钥，已经发送过时直接返回
+func (r *msgQue) startKeyExchange() bool {
+	r.callbackLock.Lock()
+	exchange, err := r.prepareKeyExchange()
+	if err != nil {
+		r.callbackLock.Unlock()
+		LogError("[msgque]key exchange failed msgque:%v err:%v", r.id, err)
+		return false
+	}
+	if exchange.started {
+		r.callbackLock.Unlock()
+		return true
+	}
+	exchange.started = true
+	r.callbackLock.Unlock()
+	return r.pushKeyExchange(exchange.pub)
+}
+
+//创建密钥交换，之后发送的消息缓存到交换完成，已存在时返回进行中的交换，调用者持有callbackLock
+func (r *msgQue) prepareKeyExchange() (*keyExchange, error) {
+	if r.exchange != nil {
+		return r.exchange, nil
+	}
+	exchange, err := newKeyExchange()
+	if err != nil {
+		return nil, err
+	}
+	r.exchange = exchange
+	r.cipher = nil
+	return exchange, nil
+}
+
+//写入公钥，消息队列已关闭时返回false
+func (r *msgQue) pushKeyExchange(pub []byte) (re bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			re = false
+		}
+	}()
+	if r.stop == 1 {
+		return false
+	}
+	return r.pushWrite(NewMsg(MsgIdKeyExchange, 0, pub))
+}
+
+//开启Required的消息队列创建时准备密钥交换，交换完成前发送的消息被缓存
+func (r *msgQue) requireKeyExchange() {
+	if r.kxOpts == nil || !r.kxOpts.Required || r.msgTyp != MsgTypeMsg || r.connTyp == ConnTypeListen {
+		return
+	}
+	r.callbackLock.Lock()
+	if _, err := r.prepareKeyExchange(); err != nil {
+		LogError("[msgque]key exchange failed msgque:%v err:%v", r.id, err)
+	}
+	r.callbackLock.Unlock()
+}
+
+//连接成功后发出准备好的密钥交换
+func (r *msgQue) connectKeyExchange() {
+	r.callbackLock.Lock()
+	exchange := r.exchange
+	r.callbackLock.Unlock()
+	if exchange != nil {
+		r.startKeyExchange()
+	}
+}
+
+//重连前清除上一个连接的会话密钥，上一个连接进行过密钥交换时准备新的交换，连接成功后发出
+//写入通道中使用旧密钥加密的消息解密后缓存，新的交换完成后重新加密发出
+func (r *msgQue) resetKeyExchange() {
+	r.callbackLock.Lock()
+	old := r.exchange
+	if !r.encryptRequired && (old == nil || !old.started) {
+		r.callbackLock.Unlock()
+		return
+	}
+	c := r.cipher
+	r.cipher = nil
+	r.exchange = nil
+	r.encryptRequired = false
+	exchange, err := r.prepareKeyExchange()
+	if err != nil {
+		r.callbackLock.Unlock()
+		LogError("[msgque]key exchange failed msgque:%v err:%v", r.id, err)
+		return
+	}
+	if old != nil {
+		exchange.pending = old.pending
+	}
+	r.callbackLock.Unlock()
+	held := r.takeEncrypted(c)
+	r.callbackLock.Lock()
+	exchange.pending = append(held, exchange.pending...)
+	r.callbackLock.Unlock()
+}
+
+//取出写入通道中已加密的消息并解密，其他消息按原顺序放回，无法解密的消息和分片丢弃
+func (r *msgQue) takeEncrypted(c ICipher) []*Message {
+	var held []*Message
+	for n := len(r.cwrite); n > 0; n-- {
+		var m *Message
+		select {
+		case m = <-r.cwrite:
+		default:
+			return held
+		}
+		if m == nil || m.Head == nil || m.Head.Flags&FlagEncrypt == 0 {
+			select {
+			case r.cwrite <- m:
+			default:
+				if m != nil {
+					r.drop(m)
+				}
+			}
+			continue
+		}
+		if c == nil || m.Head.Flags&FlagContinue > 0 {
+			r.drop(m)
+			continue
+		}
+		data, err := c.Decrypt(m.Data)
+		if err != nil {
+			r.drop(m)
+			continue
+		}
+		m.Data = data
+		m.Head.Flags &^= FlagEncrypt
+		m.Head.Len = uint32(len(data))
+		held = append(held, m)
+	}
+	return held
+}
+
+//交换完成前缓存待加密的消息，返回true表示已缓存
+func (r *msgQue) holdForKeyExchange(m *Message) bool {
+	r.callbackLock.Lock()
+	defer r.callbackLock.Unlock()
+	if r.exchange == nil {
+		return false
+	}
+	m.retain()
+	r.exchange.pending = append(r.exchange.pending, m)
+	return true
+}
+
+//处理对端的公钥，未发起交换的一端先回应自己的公钥
+func (r *msgQue) onKeyExchange(msg *Message) bool {
+	if len(msg.Data) != curve25519.PointSize {
+		LogError("[msgque]key exchange pub key invalid msgque:%v len:%v", r.id, len(msg.Data))
+		return false
+	}
+	r.callbackLock.Lock()
+	exchange, err := r.prepareKeyExchange()
+	if err != nil {
+		r.callbackLock.Unlock()
+		LogError("[msgque]key exchange failed msgque:%v err:%v", r.id, err)
+		return false
+	}
+	response := !exchange.started
+	exchange.started = true
+	r.callbackLock.Unlock()
+	if response && !r.pushKeyExchange(exchange.pub) {
+		return false
+	}
+
+	c, err := exchange.cipher(msg.Data, r.kxOpts.Psk)
+	if err != nil {
+		LogError("[msgque]key exchange failed msgque:%v err:%v", r.id, err)
+		return false
+	}
+	r.callbackLock.Lock()
+	r.cipher = c
+	r.encryptRequired = true
+	r.exchange = nil
+	pending := exchange.pending
+	exchange.pending = nil
+	r.callbackLock.Unlock()
+	LogDebug("[msgque]key exchange complete msgque:%v", r.id)
+	//缓存的消息已经过会话层，直接发送
+	for _, m := range pending {
+		r.sendDirect(m)
+		m.Release()
+	}
+	return true
+}
+
+//开启Required时交换完成前只接受密钥交换消息
+func (r *msgQue) isKeyExchangePending() bool {
+	if r.kxOpts == nil || !r.kxOpts.Required {
+		return false
+	}
+	return !r.isEncryptRequired()
+}
+
+//密钥交换完成后只接受加密的消息
+func (r *msgQue) isEncryptRequired() bool {
+	r.callbackLock.Lock()
+	defer r.callbackLock.Unlock()
+	return r.encryptRequired
+}
@@ -0,0 +1,253 @@
+package easynet
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+type testKxClient struct {
+	DefMsgHandler
+	dead chan bool
+	got  chan *Message
+}
+
+func (r *testKxClient) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	if r.got != nil {
+		r.got <- &Message{Head: msg.Head, Data: append([]byte(nil), msg.Data...)}
+	}
+	return true
+}
+
+func (r *testKxClient) OnConnectComplete(msgque IMsgQue, ok bool) bool {
+	if ok {
+		msgque.KeyExchange()
+	}
+	return true
+}
+
+func (r *testKxClient) OnDelMsgQue(msgque IMsgQue) {
+	select {
+	case r.dead <- true:
+	default:
+	}
+}
+
+//连接关闭时通知
+type testDeadHandler struct {
+	DefMsgHandler
+	dead chan bool
+}
+
+func (r *testDeadHandler) OnDelMsgQue(msgque IMsgQue) {
+	select {
+	case r.dead <- true:
+	default:
+	}
+}
+
+type testRecvHandler struct {
+	DefMsgHandler
+	got chan *Message
+}
+
+func (r *testRecvHandler) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	r.got <- &Message{Head: msg.Head, Data: append([]byte(nil), msg.Data...)}
+	return true
+}
+
+func TestKeyExchange(t *testing.T) {
+	opts := &MsgQueOptions{KeyExchange: &KeyExchangeOptions{Psk: []byte("psk")}}
+	if err := StartServerWithOptions("tcp://127.0.0.1:29121", MsgTypeMsg, &testEchoHandler{}, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	h := &testKxClient{dead: make(chan bool, 1)}
+	c := StartConnectWithOptions("tcp", "127.0.0.1:29121", MsgTypeMsg, h, nil, nil, opts)
+	defer c.Stop()
+	m, err := c.Call(context.Background(), NewMsg(1, 0, []byte("secret")))
+	if err != nil || string(m.Data) != "secret" || c.GetCipher() == nil {
+		t.Fatal(m, err)
+	}
+
+	//密钥交换完成后收到未加密的消息关闭连接
+	c.(*tcpMsgQue).pushWrite(NewMsg(1, 0, []byte("plain")))
+	select {
+	case <-h.dead:
+	case <-time.After(3 * time.Second):
+		t.Fatal("plain msg accepted after key exchange")
+	}
+}
+
+func TestKeyExchangePskMismatch(t *testing.T) {
+	if err := StartServerWithOptions("tcp://127.0.0.1:29122", MsgTypeMsg, &testEchoHandler{}, nil, &MsgQueOptions{KeyExchange: &KeyExchangeOptions{Psk: []byte("a")}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	h := &testKxClient{dead: make(chan bool, 1)}
+	c := StartConnectWithOptions("tcp", "127.0.0.1:29122", MsgTypeMsg, h, nil, nil, &MsgQueOptions{KeyExchange: &KeyExchangeOptions{Psk: []byte("b")}})
+	defer c.Stop()
+	time.Sleep(100 * time.Millisecond)
+	c.Send(NewMsg(1, 0, []byte("secret")))
+	select {
+	case <-h.dead:
+	case <-time.After(3 * time.Second):
+		t.Fatal("psk mismatch not closed")
+	}
+}
+
+//未开启密钥交换时保留的消息ID作为普通消息处理
+func TestKeyExchangeNotEnabled(t *testing.T) {
+	h := &testRecvHandler{got: make(chan *Message, 1)}
+	if err := StartServer("tcp://127.0.0.1:29123", MsgTypeMsg, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c := StartConnect("tcp", "127.0.0.1:29123", MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+	defer c.Stop()
+	c.Send(NewMsg(MsgIdKeyExchange, 0, []byte("app")))
+	select {
+	case m := <-h.got:
+		if m.Id() != MsgIdKeyExchange || string(m.Data) != "app" {
+			t.Fatal(m)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("reserved id intercepted")
+	}
+}
+
+//重连后重新交换密钥，断线期间发送的消息使用新的会话密钥发出
+func TestKeyExchangeReconnect(t *testing.T) {
+	opts := &MsgQueOptions{KeyExchange: &KeyExchangeOptions{Psk: []byte("psk")}}
+	if err := StartServerWithOptions("tcp://127.0.0.1:29124", MsgTypeMsg, &testEchoHandler{}, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	h := &testKxClient{dead: make(chan bool, 1), got: make(chan *Message, 1)}
+	c := StartConnectWithOptions("tcp", "127.0.0.1:29124", MsgTypeMsg, h, nil, nil, &MsgQueOptions{
+		KeyExchange: opts.KeyExchange,
+		Reconnect:   &ReconnectPolicy{MinDelay: 100, MaxDelay: 100},
+	})
+	defer c.Close()
+	call := func(data string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		m, err := c.Call(ctx, NewMsg(1, 0, []byte(data)))
+		if err != nil || string(m.Data) != data {
+			t.Fatal(data, m, err)
+		}
+	}
+	call("first")
+	old := c.GetCipher()
+
+	c.(*tcpMsgQue).conn.Close()
+	<-h.dead
+	c.Send(NewMsg(2, 0, []byte("during reconnect")))
+	select {
+	case m := <-h.got:
+		if string(m.Data) != "during reconnect" {
+			t.Fatal(string(m.Data))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("msg sent during reconnect lost")
+	}
+	if c.GetCipher() == nil || c.GetCipher() == old {
+		t.Fatal("session key not renewed")
+	}
+	call("after reconnect")
+}
+
+//重连前写入通道中使用旧密钥加密的消息解密后缓存到新的交换
+func TestKeyExchangeReset(t *testing.T) {
+	c, _ := NewAesGcmCipher(make([]byte, 32))
+	q := &msgQue{msgTyp: MsgTypeMsg, cwrite: make(chan *Message, 4), cipher: c, encryptRequired: true}
+	q.sendDirect(NewMsg(1, 0, []byte("old")))
+	q.pushWrite(NewMsg(2, 0, nil))
+	q.resetKeyExchange()
+	if q.cipher != nil || q.encryptRequired || q.exchange == nil || q.exchange.started {
+		t.Fatal("not reset")
+	}
+	if len(q.cwrite) != 1 || len(q.exchange.pending) != 1 {
+		t.Fatal("cwrite", len(q.cwrite), "pending", len(q.exchange.pending))
+	}
+	if m := q.exchange.pending[0]; string(m.Data) != "old" || m.Head.Flags&FlagEncrypt != 0 {
+		t.Fatal("pending", m.Head, string(m.Data))
+	}
+	q.sendDirect(NewMsg(3, 0, []byte("new")))
+	if len(q.exchange.pending) != 2 {
+		t.Fatal("new msg not held")
+	}
+	if q.connectKeyExchange(); len(q.cwrite) != 2 || !q.exchange.started {
+		t.Fatal("exchange not started")
+	}
+}
+
+//服务器要求密钥交换时拒绝交换前的消息
+func TestKeyExchangeRequired(t *testing.T) {
+	opts := &MsgQueOptions{KeyExchange: &KeyExchangeOptions{Required: true}}
+	if err := StartServerWithOptions("tcp://127.0.0.1:29125", MsgTypeMsg, &testEchoHandler{}, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	h := &testDeadHandler{dead: make(chan bool, 1)}
+	plain := StartConnect("tcp", "127.0.0.1:29125", MsgTypeMsg, h, nil, nil)
+	defer plain.Stop()
+	time.Sleep(100 * time.Millisecond)
+	plain.Send(NewMsg(1, 0, []byte("plain")))
+	select {
+	case <-h.dead:
+	case <-time.After(3 * time.Second):
+		t.Fatal("plain msg accepted before key exchange")
+	}
+
+	//开启Required的连接端连接成功后自动交换
+	c := StartConnectWithOptions("tcp", "127.0.0.1:29125", MsgTypeMsg, &DefMsgHandler{}, nil, nil, opts)
+	defer c.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	m, err := c.Call(ctx, NewMsg(1, 0, []byte("secret")))
+	if err != nil || string(m.Data) != "secret" || c.GetCipher() == nil {
+		t.Fatal(m, err)
+	}
+}
+
+//消息队列关闭后不能开始密钥交换
+func TestKeyExchangeClosed(t *testing.T) {
+	q := &msgQue{msgTyp: MsgTypeMsg, cwrite: make(chan *Message, 1), stop: 1}
+	if q.KeyExchange() {
+		t.Fatal("key exchange on stopped msgque")
+	}
+	q = &msgQue{msgTyp: MsgTypeMsg, cwrite: make(chan *Message, 1)}
+	close(q.cwrite)
+	if q.KeyExchange() {
+		t.Fatal("key exchange on closed write channel")
+	}
+}
+
+//先压缩后加密
+func TestCompressBeforeEncrypt(t *testing.T) {
+	old := Config.AutoCompressLen
+	Config.AutoCompressLen = 64
+	defer func() { Config.AutoCompressLen = old }()
+	c, err := NewAesGcmCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &msgQue{cwrite: make(chan *Message, 1), cipher: c, compressor: GetCompressor(CompressorFlate)}
+	data := bytes.Repeat([]byte("easynet"), 1000)
+	if !q.sendDirect(NewMsg(1, 0, data)) {
+		t.Fatal("send failed")
+	}
+	m := <-q.cwrite
+	if m.Head.Flags&(FlagCompress|FlagEncrypt) != FlagCompress|FlagEncrypt || len(m.Data) >= len(data)/2 {
+		t.Fatal(m.Head.Flags, len(m.Data))
+	}
+	plain, err := c.Decrypt(m.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.unCompress(&Message{Head: &MessageHead{Flags: m.Head.Flags &^ FlagEncrypt, Len: uint32(len(plain))}, Data: plain}); err != nil {
+		t.Fatal(err)
+	}
+}
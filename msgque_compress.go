@@ -0,0 +1,182 @@
+/*
+@Time       : 2022/6/30
+@Author     : wuqiusheng
+@File       : msgque_compress.go
+@Description: 消息压缩，压缩算法可注册，每个消息队列可单独设置
+			gzip保持原有格式，只带FlagCompress
+			其他算法带FlagCompress|FlagCodec，数据首字节为压缩算法id
+*/
+package easynet
+
+import (
+	"bytes"
+	"compress/flate"
+	"easyutil"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	CompressorGzip  uint8 = iota //gzip，默认，兼容旧版本
+	CompressorFlate              //flate，复用writer和reader，适合高频小消息
+)
+
+type ICompressor interface {
+	Id() uint8
+	Compress(dst, data []byte) ([]byte, error) //压缩结果追加到dst
+	UnCompress(data []byte) ([]byte, error)
+}
+
+var compressorMap sync.Map //map[uint8]ICompressor
+
+//注册压缩算法，id相同的会被覆盖
+func RegisterCompressor(c ICompressor) {
+	compressorMap.Store(c.Id(), c)
+}
+
+func GetCompressor(id uint8) ICompressor {
+	if c, ok := compressorMap.Load(id); ok {
+		return c.(ICompressor)
+	}
+	return nil
+}
+
+type GzipCompressor struct{}
+
+func (r *GzipCompressor) Id() uint8 {
+	return CompressorGzip
+}
+
+func (r *GzipCompressor) Compress(dst, data []byte) ([]byte, error) {
+	return append(dst, easyutil.GZipCompress(data)...), nil
+}
+
+func (r *GzipCompressor) UnCompress(data []byte) ([]byte, error) {
+	return easyutil.GZipUnCompress(data)
+}
+
+type FlateCompressor struct {
+	Level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (r *FlateCompressor) Id() uint8 {
+	return CompressorFlate
+}
+
+func (r *FlateCompressor) Compress(dst, data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	var w *flate.Writer
+	if v := r.writers.Get(); v != nil {
+		w = v.(*flate.Writer)
+		w.Reset(buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(buf, r.Level); err != nil {
+			return nil, err
+		}
+	}
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	r.writers.Put(w)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *FlateCompressor) UnCompress(data []byte) ([]byte, error) {
+	var fr io.ReadCloser
+	if v := r.readers.Get(); v != nil {
+		fr = v.(io.ReadCloser)
+		fr.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	} else {
+		fr = flate.NewReader(bytes.NewReader(data))
+	}
+	//限制解压后的长度，防止压缩炸弹
+	out, err := ioutil.ReadAll(io.LimitReader(fr, int64(MaxReassembleSize)+1))
+	fr.Close()
+	r.readers.Put(fr)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(out)) > MaxReassembleSize {
+		return nil, ErrMsgLenTooLong
+	}
+	return out, nil
+}
+
+func (r *msgQue) SetCompressor(c ICompressor) {
+	r.compressor = c
+}
+
+//未设置时使用Config.Compressor
+func (r *msgQue) GetCompressor() ICompressor {
+	if r.compressor != nil {
+		return r.compressor
+	}
+	return defCompressor()
+}
+
+func defCompressor() ICompressor {
+	if c := GetCompressor(Config.Compressor); c != nil {
+		return c
+	}
+	return GetCompressor(CompressorGzip)
+}
+
+func (r *msgQue) compress(m *Message) error {
+	return compressMsg(r.GetCompressor(), m)
+}
+
+func compressMsg(c ICompressor, m *Message) error {
+	var dst []byte
+	flags := uint8(FlagCompress)
+	if c.Id() != CompressorGzip {
+		dst = make([]byte, 1, len(m.Data)/2+1)
+		dst[0] = c.Id()
+		flags |= FlagCodec
+	}
+	data, err := c.Compress(dst, m.Data)
+	if err != nil {
+		return err
+	}
+	m.Head.Flags |= flags
+	m.Data = data
+	m.Head.Len = uint32(len(m.Data))
+	return nil
+}
+
+func (r *msgQue) unCompress(msg *Message) error {
+	var c ICompressor
+	data := msg.Data
+	if msg.Head.Flags&FlagCodec > 0 {
+		if len(data) < 1 {
+			return ErrMsgLenTooShort
+		}
+		c = GetCompressor(data[0])
+		data = data[1:]
+	} else {
+		c = GetCompressor(CompressorGzip)
+	}
+	if c == nil {
+		return ErrMsgNoHandle
+	}
+	data, err := c.UnCompress(data)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	msg.Head.Flags &^= FlagCompress | FlagCodec
+	msg.Head.Len = uint32(len(msg.Data))
+	return nil
+}
+
+func init() {
+	RegisterCompressor(&GzipCompressor{})
+	RegisterCompressor(&FlateCompressor{Level: flate.BestSpeed})
+}
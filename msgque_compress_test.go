@@ -0,0 +1,113 @@
+package easynet
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+//反转数据的压缩算法，用于测试注册
+type testReverseCompressor struct{}
+
+func (r *testReverseCompressor) Id() uint8 {
+	return 9
+}
+
+func (r *testReverseCompressor) Compress(dst, data []byte) ([]byte, error) {
+	for i := len(data) - 1; i >= 0; i-- {
+		dst = append(dst, data[i])
+	}
+	return dst, nil
+}
+
+func (r *testReverseCompressor) UnCompress(data []byte) ([]byte, error) {
+	return r.Compress(nil, data)
+}
+
+//gzip只带FlagCompress，其他算法带FlagCodec和算法id，接收方按标记选择算法
+func TestCompressRoundTrip(t *testing.T) {
+	RegisterCompressor(&testReverseCompressor{})
+	data := bytes.Repeat([]byte("easynet"), 1000)
+	for _, c := range []ICompressor{GetCompressor(CompressorGzip), GetCompressor(CompressorFlate), GetCompressor(9)} {
+		for i := 0; i < 3; i++ {
+			m := NewMsg(1, 0, append([]byte(nil), data...))
+			if err := compressMsg(c, m); err != nil {
+				t.Fatalf("%T compress %v", c, err)
+			}
+			if c.Id() == CompressorGzip && m.Flags() != FlagCompress {
+				t.Fatalf("gzip flags %v", m.Flags())
+			}
+			if c.Id() != CompressorGzip && (m.Flags() != FlagCompress|FlagCodec || m.Data[0] != c.Id()) {
+				t.Fatalf("%T flags %v id %v", c, m.Flags(), m.Data[0])
+			}
+			if err := (&msgQue{}).unCompress(m); err != nil || !bytes.Equal(m.Data, data) || m.Flags() != 0 || m.Len() != uint32(len(data)) {
+				t.Fatalf("%T uncompress %v flags %v", c, err, m.Flags())
+			}
+		}
+	}
+
+	//未注册的算法
+	m := &Message{Head: &MessageHead{Flags: FlagCompress | FlagCodec, Len: 2}, Data: []byte{200, 0}}
+	if err := (&msgQue{}).unCompress(m); err != ErrMsgNoHandle {
+		t.Fatal("unknown codec", err)
+	}
+}
+
+//解压后超过MaxReassembleSize返回错误
+func TestFlateBomb(t *testing.T) {
+	old := MaxReassembleSize
+	MaxReassembleSize = 1024
+	defer func() { MaxReassembleSize = old }()
+	c := GetCompressor(CompressorFlate)
+	data, err := c.Compress(nil, make([]byte, 64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UnCompress(data); err != ErrMsgLenTooLong {
+		t.Fatal("bomb", err)
+	}
+}
+
+//每个消息队列单独设置压缩算法，超过AutoCompressLen自动压缩
+func TestCompressMsgQue(t *testing.T) {
+	old := Config.AutoCompressLen
+	Config.AutoCompressLen = 64
+	defer func() { Config.AutoCompressLen = old }()
+	q := &msgQue{cwrite: make(chan *Message, 2), compressor: GetCompressor(CompressorFlate)}
+	q.sendDirect(NewMsg(1, 0, make([]byte, 63)))
+	q.sendDirect(NewMsg(1, 0, make([]byte, 64)))
+	if m := <-q.cwrite; m.Flags() != 0 {
+		t.Fatal("short msg compressed")
+	}
+	if m := <-q.cwrite; m.Flags() != FlagCompress|FlagCodec || m.Data[0] != CompressorFlate {
+		t.Fatal("msg not compressed", m.Flags())
+	}
+
+	h := &testRecvHandler{got: make(chan *Message, 1)}
+	if err := StartServer("tcp://127.0.0.1:29181", MsgTypeMsg, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c := StartConnect("tcp", "127.0.0.1:29181", MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+	defer c.Stop()
+	c.SetCompressor(GetCompressor(CompressorFlate))
+	if c.GetCompressor().Id() != CompressorFlate {
+		t.Fatal("compressor not set")
+	}
+	data := bytes.Repeat([]byte("easynet"), 1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for i := 0; i < 50 && !c.Available(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Send(NewMsg(1, 0, append([]byte(nil), data...)))
+	select {
+	case m := <-h.got:
+		if !bytes.Equal(m.Data, data) || m.Flags()&(FlagCompress|FlagCodec) != 0 {
+			t.Fatal("len", len(m.Data), m.Flags())
+		}
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
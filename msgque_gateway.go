@@ -0,0 +1,298 @@
+/*
+@Time       : 2022/7/24
+@Author     : wuqiusheng
+@File       : msgque_gateway.go
+@Description: 网关，保持客户端连接，按消息id范围或自定义路由把消息转发到后端服务的连接池
+			网关与后端之间的消息数据前4字节为客户端会话id(客户端消息队列id)，字节序同消息头，Id和Index保持不变
+			后端回应和推送时带上会话id，会话id为0表示推送给网关的所有客户端
+			客户端断开时向转发过的后端发送MsgIdGateway/GatewayIndexClose，后端发送同样的消息可以踢掉客户端
+*/
+package easynet
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MsgIdGateway uint16 = 0xFFFD //网关控制消息ID，保留
+)
+
+const (
+	GatewayIndexClose = 0 //网关到后端表示客户端断开，后端到网关表示踢掉客户端，数据为会话id
+)
+
+const gatewaySessionSize = 4
+
+var gatewayId uint32
+
+//打包网关与后端之间的消息，session为0表示推送给所有客户端
+func GatewayPack(session uint32, m *Message) *Message {
+	data := make([]byte, gatewaySessionSize+len(m.Data))
+	msgHeadByteOrder.PutUint32(data, session)
+	copy(data[gatewaySessionSize:], m.Data)
+	return NewMsg(m.Id(), m.Index(), data)
+}
+
+//解包网关与后端之间的消息，返回会话id和原始消息，原始消息的数据与msg共享
+func GatewayUnpack(msg *Message) (uint32, *Message, error) {
+	if msg.Head == nil || len(msg.Data) < gatewaySessionSize {
+		return 0, nil, ErrMsgLenTooShort
+	}
+	session := msgHeadByteOrder.Uint32(msg.Data)
+	m := NewMsg(msg.Head.Id, msg.Head.Index, msg.Data[gatewaySessionSize:])
+	m.User = msg.User
+	m.buf = msg.buf
+	return session, m, nil
+}
+
+//客户端断开或踢掉客户端的消息
+func GatewayCloseMsg(session uint32) *Message {
+	return GatewayPack(session, NewTagMsg(MsgIdGateway, GatewayIndexClose))
+}
+
+//网关路由，返回连接池名字，返回空字符串时使用消息id范围路由
+type GatewayRouter func(client IMsgQue, msg *Message) string
+
+//网关选择连接池中连接的key，用于BalanceHash
+type GatewayKeyFunc func(client IMsgQue, msg *Message) string
+
+type gatewayRoute struct {
+	minId uint16
+	maxId uint16
+	pool  string
+}
+
+type gatewaySession struct {
+	client   IMsgQue
+	backends map[uint32]IMsgQue //转发过消息的后端，断开时通知
+}
+
+type Gateway struct {
+	pools    map[string]*MsgQuePool
+	routes   []gatewayRoute
+	router   GatewayRouter
+	key      GatewayKeyFunc
+	sessions map[uint32]*gatewaySession
+	group    string //所有客户端所在的分组，用于推送
+	lock     sync.RWMutex
+}
+
+func NewGateway() *Gateway {
+	return &Gateway{
+		pools:    map[string]*MsgQuePool{},
+		sessions: map[uint32]*gatewaySession{},
+		group:    "gateway:" + strconv.Itoa(int(atomic.AddUint32(&gatewayId, 1))),
+	}
+}
+
+//添加后端连接池，pool需要使用BackendHandler创建
+func (r *Gateway) AddPool(name string, pool *MsgQuePool) {
+	r.lock.Lock()
+	r.pools[name] = pool
+	r.lock.Unlock()
+}
+
+//创建后端连接池并添加，参数同NewMsgQuePool
+func (r *Gateway) NewPool(name string, netType string, addrs []string, count int, balance BalanceType, opts *MsgQueOptions) *MsgQuePool {
+	pool := NewMsgQuePool(netType, addrs, count, balance, MsgTypeMsg, r.BackendHandler(), nil, opts)
+	r.AddPool(name, pool)
+	return pool
+}
+
+//通过服务发现创建后端连接池并添加，连接池名字为服务名
+func (r *Gateway) ResolvePool(registry *MicroServiceRegistry, name string, netType string, count int, balance BalanceType, opts *MsgQueOptions) *MsgQuePool {
+	pool := registry.Resolve(name, netType, count, balance, MsgTypeMsg, r.BackendHandler(), nil, opts)
+	r.AddPool(name, pool)
+	return pool
+}
+
+//消息id在[minId, maxId]范围内的消息转发到连接池pool，先添加的范围优先
+func (r *Gateway) Route(minId, maxId uint16, pool string) {
+	r.lock.Lock()
+	r.routes = append(r.routes, gatewayRoute{minId: minId, maxId: maxId, pool: pool})
+	r.lock.Unlock()
+}
+
+//设置自定义路由，优先于消息id范围路由
+func (r *Gateway) SetRouter(router GatewayRouter) {
+	r.lock.Lock()
+	r.router = router
+	r.lock.Unlock()
+}
+
+//设置选择后端连接的key，默认为会话id，配合BalanceHash使同一客户端固定转发到同一后端
+func (r *Gateway) SetKey(key GatewayKeyFunc) {
+	r.lock.Lock()
+	r.key = key
+	r.lock.Unlock()
+}
+
+//获取客户端消息队列
+func (r *Gateway) Session(session uint32) IMsgQue {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if s, ok := r.sessions[session]; ok {
+		return s.client
+	}
+	return nil
+}
+
+//客户端数量
+func (r *Gateway) SessionCount() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.sessions)
+}
+
+//客户端消息队列的处理器，handler处理连接事件，GetHandlerFunc返回nil的消息转发到后端
+func (r *Gateway) ClientHandler(handler IMsgHandler) IMsgHandler {
+	if handler == nil {
+		handler = &DefMsgHandler{}
+	}
+	return &gatewayClientHandler{IMsgHandler: handler, gateway: r}
+}
+
+//后端连接池的处理器
+func (r *Gateway) BackendHandler() IMsgHandler {
+	return &gatewayBackendHandler{gateway: r}
+}
+
+func (r *Gateway) addSession(client IMsgQue) {
+	r.lock.Lock()
+	r.sessions[client.Id()] = &gatewaySession{client: client, backends: map[uint32]IMsgQue{}}
+	r.lock.Unlock()
+	client.SetGroupId(r.group)
+}
+
+//移除会话并通知转发过的后端
+func (r *Gateway) delSession(client IMsgQue) {
+	r.lock.Lock()
+	s, ok := r.sessions[client.Id()]
+	delete(r.sessions, client.Id())
+	r.lock.Unlock()
+	if !ok {
+		return
+	}
+	for _, backend := range s.backends {
+		backend.Send(GatewayCloseMsg(client.Id()))
+	}
+}
+
+//选择后端连接，没有路由或可用连接时返回nil
+func (r *Gateway) backend(client IMsgQue, msg *Message) IMsgQue {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	name := ""
+	if r.router != nil {
+		name = r.router(client, msg)
+	}
+	if name == "" {
+		for _, route := range r.routes {
+			if msg.Head.Id >= route.minId && msg.Head.Id <= route.maxId {
+				name = route.pool
+				break
+			}
+		}
+	}
+	pool := r.pools[name]
+	if pool == nil {
+		return nil
+	}
+	key := ""
+	if r.key != nil {
+		key = r.key(client, msg)
+	} else {
+		key = strconv.Itoa(int(client.Id()))
+	}
+	return pool.Get(key)
+}
+
+//转发客户端消息到后端
+func (r *Gateway) forward(client IMsgQue, msg *Message) bool {
+	if msg.Head == nil {
+		LogError("[gateway]msg without head msgque:%v", client.Id())
+		return false
+	}
+	if msg.Head.Id == MsgIdGateway {
+		LogWarn("[gateway]client send reserved msg id:%v msgque:%v", msg.Head.Id, client.Id())
+		return true
+	}
+	backend := r.backend(client, msg)
+	if backend == nil {
+		LogWarn("[gateway]no backend for msg id:%v msgque:%v", msg.Head.Id, client.Id())
+		return true
+	}
+	r.lock.Lock()
+	if s, ok := r.sessions[client.Id()]; ok {
+		s.backends[backend.Id()] = backend
+	}
+	r.lock.Unlock()
+	backend.Send(GatewayPack(client.Id(), msg))
+	return true
+}
+
+//处理后端消息，回应或推送给客户端
+func (r *Gateway) dispatch(backend IMsgQue, msg *Message) bool {
+	session, m, err := GatewayUnpack(msg)
+	if err != nil {
+		LogError("[gateway]backend msg err:%v msgque:%v", err, backend.Id())
+		return true
+	}
+	if m.Head.Id == MsgIdGateway {
+		if m.Head.Index == GatewayIndexClose {
+			if client := r.Session(session); client != nil {
+				LogInfo("[gateway]backend kick session:%v msgque:%v", session, backend.Id())
+				client.Stop()
+			}
+		}
+		return true
+	}
+	if session == 0 {
+		SendGroup(r.group, m)
+		return true
+	}
+	if client := r.Session(session); client != nil {
+		client.Send(m)
+	}
+	return true
+}
+
+type gatewayClientHandler struct {
+	IMsgHandler
+	gateway *Gateway
+}
+
+func (r *gatewayClientHandler) OnNewMsgQue(msgque IMsgQue) bool {
+	if !r.IMsgHandler.OnNewMsgQue(msgque) {
+		return false
+	}
+	r.gateway.addSession(msgque)
+	return true
+}
+
+func (r *gatewayClientHandler) OnDelMsgQue(msgque IMsgQue) {
+	r.gateway.delSession(msgque)
+	r.IMsgHandler.OnDelMsgQue(msgque)
+}
+
+func (r *gatewayClientHandler) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	return r.gateway.forward(msgque, msg)
+}
+
+//嵌入的消息处理器是接口，需要转发可选接口
+func (r *gatewayClientHandler) OnSendHighWater(msgque IMsgQue, pending int) {
+	if handler, ok := r.IMsgHandler.(ISendHighWaterHandler); ok {
+		handler.OnSendHighWater(msgque, pending)
+	}
+}
+
+type gatewayBackendHandler struct {
+	DefMsgHandler
+	gateway *Gateway
+}
+
+func (r *gatewayBackendHandler) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	return r.gateway.dispatch(msgque, msg)
+}
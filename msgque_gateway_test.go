@@ -0,0 +1,135 @@
+package easynet
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//后端服务，回应带会话id的消息，记录客户端断开通知
+type testGatewayBackend struct {
+	testAcceptHandler
+	got    chan *Message //去掉会话id的消息，User为会话id
+	closed chan uint32
+}
+
+func (r *testGatewayBackend) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	session, m, err := GatewayUnpack(msg)
+	if err != nil {
+		return false
+	}
+	if m.Id() == MsgIdGateway {
+		r.closed <- session
+		return true
+	}
+	r.got <- &Message{Head: m.Head, Data: append([]byte(nil), m.Data...), User: session}
+	msgque.Send(GatewayPack(session, NewMsg(m.Id(), m.Index(), append([]byte("re:"), m.Data...))))
+	return true
+}
+
+func testRecvData(t *testing.T, got chan *Message, data string) *Message {
+	select {
+	case m := <-got:
+		if string(m.Data) != data {
+			t.Fatal("recv", string(m.Data), "want", data)
+		}
+		return m
+	case <-time.After(3 * time.Second):
+		t.Fatal("recv timeout", data)
+	}
+	return nil
+}
+
+//客户端消息带会话id转发到后端，后端回应给对应客户端，会话id为0时推送给所有客户端，客户端断开时通知后端
+func TestGatewayForward(t *testing.T) {
+	b := &testGatewayBackend{testAcceptHandler: testAcceptHandler{accepted: make(chan IMsgQue, 1)}, got: make(chan *Message, 4), closed: make(chan uint32, 2)}
+	if err := StartServer("tcp://127.0.0.1:29221", MsgTypeMsg, b, nil); err != nil {
+		t.Fatal(err)
+	}
+	g := NewGateway()
+	if err := StartServer("tcp://127.0.0.1:29222", MsgTypeMsg, g.ClientHandler(nil), nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	pool := g.NewPool("svc", "tcp", []string{"127.0.0.1:29221"}, 1, BalanceRoundRobin, nil)
+	defer pool.Close()
+	g.Route(1, 100, "svc")
+	var backend IMsgQue
+	select {
+	case backend = <-b.accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("backend accept timeout")
+	}
+
+	var hs []*testRecvHandler
+	for i := 0; i < 2; i++ {
+		h := &testRecvHandler{got: make(chan *Message, 4)}
+		hs = append(hs, h)
+		c := StartConnect("tcp", "127.0.0.1:29222", MsgTypeMsg, h, nil, nil)
+		defer c.Stop()
+		if i == 0 {
+			for j := 0; j < 50 && (!c.Available() || pool.Len() == 0); j++ {
+				time.Sleep(20 * time.Millisecond)
+			}
+			c.Send(NewMsg(1, 7, []byte("hello")))
+		}
+	}
+	m := testRecvData(t, b.got, "hello")
+	session := m.User.(uint32)
+	if m.Id() != 1 || m.Index() != 7 || g.Session(session) == nil {
+		t.Fatal("forward", m.Id(), m.Index(), session)
+	}
+	if r := testRecvData(t, hs[0].got, "re:hello"); r.Id() != 1 || r.Index() != 7 {
+		t.Fatal("reply", r.Id(), r.Index())
+	}
+
+	for i := 0; i < 50 && g.SessionCount() < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	backend.Send(GatewayPack(0, NewMsg(2, 0, []byte("all"))))
+	testRecvData(t, hs[0].got, "all")
+	testRecvData(t, hs[1].got, "all")
+
+	//客户端断开，通知转发过的后端
+	g.Session(session).Stop()
+	select {
+	case closed := <-b.closed:
+		if closed != session {
+			t.Fatal("closed session", closed, session)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("close notify timeout")
+	}
+	if g.SessionCount() != 1 {
+		t.Fatal("sessions", g.SessionCount())
+	}
+
+	//后端踢掉客户端
+	g.lock.RLock()
+	for id := range g.sessions {
+		backend.Send(GatewayCloseMsg(id))
+	}
+	g.lock.RUnlock()
+	for i := 0; i < 50 && g.SessionCount() != 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if g.SessionCount() != 0 {
+		t.Fatal("not kicked")
+	}
+}
+
+//客户端消息队列的处理器转发高水位回调
+func TestGatewayClientHighWater(t *testing.T) {
+	g := NewGateway()
+	for _, h := range []IMsgHandler{&testHighWaterHandler{}, nil} {
+		q := newTcpConn("tcp", "127.0.0.1:1", nil, MsgTypeMsg, g.ClientHandler(h), nil, nil)
+		q.SetHighWater(2)
+		for i := 0; i < 3; i++ {
+			q.Send(NewMsg(1, 0, nil))
+		}
+		q.Stop()
+		if hw, ok := h.(*testHighWaterHandler); ok && atomic.LoadInt32(&hw.hits) != 1 {
+			t.Fatal("hits", hw.hits)
+		}
+	}
+}
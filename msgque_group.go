@@ -0,0 +1,168 @@
+/*
+@Time       : 2022/7/5
+@Author     : wuqiusheng
+@File       : msgque_group.go
+@Description: 消息队列分组，SetGroupId时加入分组索引，关闭时自动移除
+			分组发送只遍历分组成员，消息只压缩一次，数据在成员间共享
+			设置了加密器或需要分片的成员会复制消息后单独处理
+*/
+package easynet
+
+import (
+	"sync"
+)
+
+var (
+	groupMapSync sync.RWMutex
+	groupMap     = map[string]map[uint32]IMsgQue{}
+)
+
+func addGroupMember(group string, id uint32) {
+	msgqueMapSync.Lock()
+	msgque, ok := msgqueMap[id]
+	msgqueMapSync.Unlock()
+	if !ok {
+		return
+	}
+	groupMapSync.Lock()
+	members, ok := groupMap[group]
+	if !ok {
+		members = map[uint32]IMsgQue{}
+		groupMap[group] = members
+	}
+	members[id] = msgque
+	groupMapSync.Unlock()
+}
+
+func delGroupMember(group string, id uint32) {
+	groupMapSync.Lock()
+	if members, ok := groupMap[group]; ok {
+		delete(members, id)
+		if len(members) == 0 {
+			delete(groupMap, group)
+		}
+	}
+	groupMapSync.Unlock()
+}
+
+//分组成员
+func GroupMembers(group string) []IMsgQue {
+	groupMapSync.RLock()
+	defer groupMapSync.RUnlock()
+	members := groupMap[group]
+	list := make([]IMsgQue, 0, len(members))
+	for _, msgque := range members {
+		list = append(list, msgque)
+	}
+	return list
+}
+
+func GroupCount(group string) int {
+	groupMapSync.RLock()
+	defer groupMapSync.RUnlock()
+	return len(groupMap[group])
+}
+
+//向分组发送消息，返回发送的消息队列数量
+func SendGroup(group string, m *Message) int {
+	return SendGroupsExclude([]string{group}, m, nil)
+}
+
+//向多个分组发送消息，同时在多个分组中的消息队列只发送一次
+func SendGroups(groups []string, m *Message) int {
+	return SendGroupsExclude(groups, m, nil)
+}
+
+//向分组发送消息，排除指定id的消息队列
+func SendGroupExclude(group string, m *Message, exclude ...uint32) int {
+	return SendGroupsExclude([]string{group}, m, exclude)
+}
+
+func SendGroupsExclude(groups []string, m *Message, exclude []uint32) int {
+	if m == nil {
+		return 0
+	}
+	var list []IMsgQue
+	groupMapSync.RLock()
+	if len(groups) == 1 {
+		members := groupMap[groups[0]]
+		list = make([]IMsgQue, 0, len(members))
+		for id, msgque := range members {
+			if !isExclude(id, exclude) {
+				list = append(list, msgque)
+			}
+		}
+	} else {
+		seen := map[uint32]bool{}
+		for _, group := range groups {
+			for id, msgque := range groupMap[group] {
+				if !seen[id] && !isExclude(id, exclude) {
+					seen[id] = true
+					list = append(list, msgque)
+				}
+			}
+		}
+	}
+	groupMapSync.RUnlock()
+	if len(list) == 0 {
+		return 0
+	}
+
+	shared := groupMsg(m)
+	if shared == nil {
+		return 0
+	}
+	cnt := 0
+	for _, msgque := range list {
+		if msgque.sendShared(shared, m) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func isExclude(id uint32, exclude []uint32) bool {
+	for _, e := range exclude {
+		if e == id {
+			return true
+		}
+	}
+	return false
+}
+
+//复制消息头并按需压缩，不修改调用者的消息
+func groupMsg(m *Message) *Message {
+	if m.Head == nil {
+		return m
+	}
+	head := *m.Head
+	msg := &Message{Head: &head, Data: m.Data, buf: m.buf}
+	if Config.AutoCompressLen > 0 && head.Len >= Config.AutoCompressLen && head.Flags&(FlagCompress|FlagEncrypt) == 0 {
+		if err := compressMsg(defCompressor(), msg); err != nil {
+			LogError("[msgque]group msg compress failed id:%v err:%v", head.Id, err)
+			return nil
+		}
+	}
+	return msg
+}
+
+//发送在多个消息队列间共享的消息，需要加密或分片时复制原始消息后单独发送
+func (r *msgQue) sendShared(m *Message, raw *Message) (re bool) {
+	if r.session != nil && m.Head != nil {
+		head := *raw.Head
+		return r.session.send(&Message{Head: &head, Data: raw.Data, buf: raw.buf})
+	}
+	if r.stop == 1 {
+		return false
+	}
+	if m.Head != nil && len(m.Data) > 0 && (r.exchange != nil || r.GetCipher() != nil || uint32(len(m.Data)) > r.getFragmentSize()) {
+		head := *raw.Head
+		return r.Send(&Message{Head: &head, Data: append([]byte(nil), raw.Data...)})
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			re = false
+		}
+	}()
+	return r.pushWrite(m)
+}
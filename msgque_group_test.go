@@ -0,0 +1,90 @@
+package easynet
+
+import (
+	"testing"
+	"time"
+)
+
+//记录accept产生的消息队列
+type testAcceptHandler struct {
+	DefMsgHandler
+	accepted chan IMsgQue
+}
+
+func (r *testAcceptHandler) OnNewMsgQue(msgque IMsgQue) bool {
+	r.accepted <- msgque
+	return true
+}
+
+//分组发送只发给成员，多个分组中的成员只发送一次，关闭后移出分组
+func TestSendGroups(t *testing.T) {
+	old := Config.AutoCompressLen
+	Config.AutoCompressLen = 10
+	defer func() { Config.AutoCompressLen = old }()
+	s := &testAcceptHandler{accepted: make(chan IMsgQue, 3)}
+	if err := StartServer("tcp://127.0.0.1:29191", MsgTypeMsg, s, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	var hs []*testRecvHandler
+	var sq, cq []IMsgQue
+	for i := 0; i < 3; i++ {
+		h := &testRecvHandler{got: make(chan *Message, 4)}
+		hs = append(hs, h)
+		c := StartConnect("tcp", "127.0.0.1:29191", MsgTypeMsg, h, nil, nil)
+		defer c.Stop()
+		cq = append(cq, c)
+		select {
+		case q := <-s.accepted:
+			sq = append(sq, q)
+		case <-time.After(3 * time.Second):
+			t.Fatal("accept timeout")
+		}
+	}
+	sq[0].SetGroupId("group-a")
+	sq[1].SetGroupId("group-a")
+	sq[1].SetGroupId("group-b")
+	sq[2].SetGroupId("group-b")
+	//设置了加密器的成员单独加密
+	sq[2].SetCipher(defCipher)
+	cq[2].SetCipher(defCipher)
+	if GroupCount("group-a") != 2 || len(GroupMembers("group-b")) != 2 || !sq[1].IsInGroup("group-b") {
+		t.Fatal("members")
+	}
+
+	data := "hello group hello group"
+	m := NewMsg(1, 0, []byte(data))
+	if n := SendGroups([]string{"group-a", "group-b"}, m); n != 3 {
+		t.Fatal("send groups", n)
+	}
+	if n := SendGroupExclude("group-a", m, sq[0].Id()); n != 1 {
+		t.Fatal("send exclude", n)
+	}
+	if m.Flags() != 0 || string(m.Data) != data {
+		t.Fatal("caller msg modified")
+	}
+	for i, cnt := range []int{1, 2, 1} {
+		for j := 0; j < cnt; j++ {
+			select {
+			case got := <-hs[i].got:
+				if string(got.Data) != data {
+					t.Fatal(i, string(got.Data))
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("timeout", i)
+			}
+		}
+	}
+	select {
+	case got := <-hs[0].got:
+		t.Fatal("excluded member received", string(got.Data))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sq[2].DelGroupId("group-b")
+	sq[1].Stop()
+	time.Sleep(100 * time.Millisecond)
+	if GroupCount("group-a") != 1 || GroupCount("group-b") != 0 || SendGroup("group-b", m) != 0 {
+		t.Fatal("not removed", GroupCount("group-a"), GroupCount("group-b"))
+	}
+}
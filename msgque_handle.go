@@ -18,6 +18,11 @@ type IMsgHandler interface {
 	GetHandlerFunc(msgque IMsgQue, msg *Message) HandlerFunc //根据消息获得处理函数
 }
 
+//可选接口，消息处理器实现后在写入通道积压达到高水位时回调
+type ISendHighWaterHandler interface {
+	OnSendHighWater(msgque IMsgQue, pending int) //写入通道积压达到高水位
+}
+
 type DefMsgHandler struct {
 	msgMap  map[uint16]HandlerFunc
 	typeMap map[reflect.Type]HandlerFunc
@@ -0,0 +1,285 @@
+/*
+@Time       : 2022/7/2
+@Author     : wuqiusheng
+@File       : msgque_head.go
+@Description: 消息头编解码，可按监听或连接设置，用于兼容不同的协议
+			DefHeadCodec    默认9字节消息头
+			VarintHeadCodec 变长消息头 uvarint(Len) uvarint(Id) uvarint(Index) Flags(1)
+			Id32HeadCodec   11字节消息头 Len(4) Id(4) Index(2) Flags(1)，Id为32位，高16位为MessageHead.IdExt
+			CrcHeadCodec    默认9字节消息头 + 数据的crc32(4)
+			多字节整数的字节序与消息头一致
+*/
+package easynet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+type IHeadCodec interface {
+	ReadHead(reader *bufio.Reader) (*MessageHead, error)          //从流中读取消息头
+	DecodeHead(data []byte) (*MessageHead, int, error)            //从完整的数据帧中解析消息头，返回消息头长度
+	EncodeHead(dst []byte, head *MessageHead, data []byte) []byte //编码消息头追加到dst，data为消息数据
+	CheckData(head *MessageHead, data []byte) error               //校验消息数据
+	MaxHeadSize() int                                             //消息头最大长度，用于分配缓冲区和计算分片长度
+}
+
+var defHeadCodec IHeadCodec = &DefHeadCodec{}
+
+//默认9字节消息头
+type DefHeadCodec struct{}
+
+func (r *DefHeadCodec) ReadHead(reader *bufio.Reader) (*MessageHead, error) {
+	data := make([]byte, MsgHeadSize)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	head, _, err := r.DecodeHead(data)
+	return head, err
+}
+
+func (r *DefHeadCodec) DecodeHead(data []byte) (*MessageHead, int, error) {
+	head := &MessageHead{}
+	if err := head.FromBytes(data); err != nil {
+		return nil, 0, err
+	}
+	return head, MsgHeadSize, nil
+}
+
+func (r *DefHeadCodec) EncodeHead(dst []byte, head *MessageHead, data []byte) []byte {
+	dst, buf := growBytes(dst, MsgHeadSize)
+	head.FastBytes(buf)
+	return dst
+}
+
+func (r *DefHeadCodec) CheckData(head *MessageHead, data []byte) error {
+	return nil
+}
+
+func (r *DefHeadCodec) MaxHeadSize() int {
+	return MsgHeadSize
+}
+
+//dst扩展n字节，返回扩展后的dst和新增的部分，容量足够时不分配内存
+func growBytes(dst []byte, n int) ([]byte, []byte) {
+	l := len(dst)
+	if cap(dst)-l >= n {
+		dst = dst[:l+n]
+	} else {
+		dst = append(dst, make([]byte, n)...)
+	}
+	return dst, dst[l:]
+}
+
+//变长消息头，小消息和小ID只需要4字节
+type VarintHeadCodec struct{}
+
+func (r *VarintHeadCodec) ReadHead(reader *bufio.Reader) (*MessageHead, error) {
+	head := &MessageHead{}
+	var v [3]uint64
+	for i := range v {
+		n, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = n
+	}
+	flags, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.fill(head, v, flags); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+func (r *VarintHeadCodec) fill(head *MessageHead, v [3]uint64, flags uint8) error {
+	if v[0] > uint64(MaxMsgDataSize) {
+		return ErrMsgLenTooLong
+	}
+	if v[1] > 0xFFFF || v[2] > 0xFFFF {
+		return ErrProtoUnPack
+	}
+	head.Len = uint32(v[0])
+	head.Id = uint16(v[1])
+	head.Index = uint16(v[2])
+	head.Flags = flags
+	return nil
+}
+
+func (r *VarintHeadCodec) DecodeHead(data []byte) (*MessageHead, int, error) {
+	head := &MessageHead{}
+	var v [3]uint64
+	pos := 0
+	for i := range v {
+		n, l := binary.Uvarint(data[pos:])
+		if l <= 0 {
+			return nil, 0, ErrMsgLenTooShort
+		}
+		v[i] = n
+		pos += l
+	}
+	if pos >= len(data) {
+		return nil, 0, ErrMsgLenTooShort
+	}
+	if err := r.fill(head, v, data[pos]); err != nil {
+		return nil, 0, err
+	}
+	return head, pos + 1, nil
+}
+
+func (r *VarintHeadCodec) EncodeHead(dst []byte, head *MessageHead, data []byte) []byte {
+	dst = appendUvarint(dst, uint64(head.Len))
+	dst = appendUvarint(dst, uint64(head.Id))
+	dst = appendUvarint(dst, uint64(head.Index))
+	return append(dst, head.Flags)
+}
+
+func (r *VarintHeadCodec) CheckData(head *MessageHead, data []byte) error {
+	return nil
+}
+
+func (r *VarintHeadCodec) MaxHeadSize() int {
+	return binary.MaxVarintLen32 + 2*3 + 1
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+const id32HeadSize = 11
+
+//11字节消息头，Id字段为32位，高16位对应MessageHead.IdExt，低16位对应MessageHead.Id
+type Id32HeadCodec struct{}
+
+func (r *Id32HeadCodec) ReadHead(reader *bufio.Reader) (*MessageHead, error) {
+	data := make([]byte, id32HeadSize)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	head, _, err := r.DecodeHead(data)
+	return head, err
+}
+
+func (r *Id32HeadCodec) DecodeHead(data []byte) (*MessageHead, int, error) {
+	if len(data) < id32HeadSize {
+		return nil, 0, ErrMsgLenTooShort
+	}
+	head := &MessageHead{Len: msgHeadByteOrder.Uint32(data)}
+	if head.Len > MaxMsgDataSize {
+		return nil, 0, ErrMsgLenTooLong
+	}
+	id := msgHeadByteOrder.Uint32(data[4:])
+	head.IdExt = uint16(id >> 16)
+	head.Id = uint16(id)
+	head.Index = msgHeadByteOrder.Uint16(data[8:])
+	head.Flags = data[10]
+	return head, id32HeadSize, nil
+}
+
+func (r *Id32HeadCodec) EncodeHead(dst []byte, head *MessageHead, data []byte) []byte {
+	dst, buf := growBytes(dst, id32HeadSize)
+	msgHeadByteOrder.PutUint32(buf, head.Len)
+	msgHeadByteOrder.PutUint32(buf[4:], head.Id32())
+	msgHeadByteOrder.PutUint16(buf[8:], head.Index)
+	buf[10] = head.Flags
+	return dst
+}
+
+func (r *Id32HeadCodec) CheckData(head *MessageHead, data []byte) error {
+	return nil
+}
+
+func (r *Id32HeadCodec) MaxHeadSize() int {
+	return id32HeadSize
+}
+
+const crcHeadSize = MsgHeadSize + 4
+
+//默认消息头之后附加数据的crc32，接收时校验
+type CrcHeadCodec struct{}
+
+func (r *CrcHeadCodec) ReadHead(reader *bufio.Reader) (*MessageHead, error) {
+	data := make([]byte, crcHeadSize)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	head, _, err := r.DecodeHead(data)
+	return head, err
+}
+
+func (r *CrcHeadCodec) DecodeHead(data []byte) (*MessageHead, int, error) {
+	if len(data) < crcHeadSize {
+		return nil, 0, ErrMsgLenTooShort
+	}
+	head := &MessageHead{}
+	if err := head.FromBytes(data); err != nil {
+		return nil, 0, err
+	}
+	head.check = msgHeadByteOrder.Uint32(data[MsgHeadSize:])
+	return head, crcHeadSize, nil
+}
+
+func (r *CrcHeadCodec) EncodeHead(dst []byte, head *MessageHead, data []byte) []byte {
+	dst, buf := growBytes(dst, crcHeadSize)
+	head.FastBytes(buf)
+	msgHeadByteOrder.PutUint32(buf[MsgHeadSize:], crc32.ChecksumIEEE(data[:head.Len]))
+	return dst
+}
+
+func (r *CrcHeadCodec) CheckData(head *MessageHead, data []byte) error {
+	if crc32.ChecksumIEEE(data) != head.check {
+		return ErrProtoUnPack
+	}
+	return nil
+}
+
+func (r *CrcHeadCodec) MaxHeadSize() int {
+	return crcHeadSize
+}
+
+func (r *msgQue) SetHeadCodec(codec IHeadCodec) {
+	r.headCodec = codec
+}
+
+func (r *msgQue) GetHeadCodec() IHeadCodec {
+	if r.headCodec != nil {
+		return r.headCodec
+	}
+	return defHeadCodec
+}
+
+//使用消息队列的消息头编码消息
+func (r *msgQue) msgBytes(m *Message) []byte {
+	if m.Head == nil || r.headCodec == nil {
+		return m.Bytes()
+	}
+	data := make([]byte, 0, r.headCodec.MaxHeadSize()+int(m.Head.Len))
+	data = r.headCodec.EncodeHead(data, m.Head, m.Data)
+	return append(data, m.Data[:m.Head.Len]...)
+}
+
+//从完整的数据帧中解析消息
+func (r *msgQue) decodeMsg(data []byte) (*Message, error) {
+	codec := r.GetHeadCodec()
+	head, n, err := codec.DecodeHead(data)
+	if err != nil {
+		return nil, err
+	}
+	if int(head.Len) != len(data)-n {
+		return nil, ErrMsgLenTooShort
+	}
+	msg := &Message{Head: head}
+	if head.Len > 0 {
+		msg.Data = data[n:]
+	}
+	if err := codec.CheckData(head, msg.Data); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,160 @@
+package easynet
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+//各消息头编解码的往返，流读取和完整帧解析结果一致
+func TestHeadCodecRoundTrip(t *testing.T) {
+	data := []byte("hello")
+	codecs := []IHeadCodec{&DefHeadCodec{}, &VarintHeadCodec{}, &Id32HeadCodec{}, &CrcHeadCodec{}}
+	for _, c := range codecs {
+		head := &MessageHead{Len: uint32(len(data)), Id: 0x1234, Index: 0x5678, Flags: FlagCompress | FlagContinue}
+		frame := append(c.EncodeHead([]byte{0xAA}, head, data)[1:], data...)
+		if len(frame)-len(data) > c.MaxHeadSize() {
+			t.Fatalf("%T head len:%v max:%v", c, len(frame)-len(data), c.MaxHeadSize())
+		}
+		got, n, err := c.DecodeHead(frame)
+		if err != nil || n != len(frame)-len(data) {
+			t.Fatalf("%T decode n:%v err:%v", c, n, err)
+		}
+		if got.Len != head.Len || got.Id != head.Id || got.Index != head.Index || got.Flags != head.Flags {
+			t.Fatalf("%T got:%v want:%v", c, got, head)
+		}
+		if err := c.CheckData(got, frame[n:]); err != nil {
+			t.Fatalf("%T check:%v", c, err)
+		}
+		rgot, err := c.ReadHead(bufio.NewReader(bytes.NewReader(frame)))
+		if err != nil || rgot.Id != head.Id || rgot.Flags != head.Flags {
+			t.Fatalf("%T read:%v err:%v", c, rgot, err)
+		}
+	}
+}
+
+func TestId32HeadCodec(t *testing.T) {
+	c := &Id32HeadCodec{}
+	msg := NewMsg32(0x89ABCDEF, 3, []byte("x"))
+	msg.Head.Flags = FlagEncrypt
+	got, _, err := c.DecodeHead(append(c.EncodeHead(nil, msg.Head, msg.Data), msg.Data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id32() != 0x89ABCDEF || got.Id != 0xCDEF || got.Index != 3 || got.Flags != FlagEncrypt {
+		t.Fatalf("got:%v id32:%x", got, got.Id32())
+	}
+}
+
+//回应时保留32位消息ID
+type testEcho32Handler struct {
+	DefMsgHandler
+}
+
+func (r *testEcho32Handler) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	msgque.Send(NewMsg(0, 0, append([]byte(nil), msg.Data...)).CopyTag(msg))
+	return true
+}
+
+//32位消息ID只有高16位不同时，回调和分片重组不会冲突
+func TestId32TagKey(t *testing.T) {
+	a, b := NewMsg32(0x10001, 7, []byte("a")), NewMsg32(0x20001, 7, []byte("b"))
+	if a.Tag() != b.Tag() || a.tagKey() == b.tagKey() {
+		t.Fatal("tag key")
+	}
+
+	opts := &MsgQueOptions{HeadCodec: &Id32HeadCodec{}}
+	if err := StartServerWithOptions("tcp://127.0.0.1:29132", MsgTypeMsg, &testEcho32Handler{}, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c := StartConnectWithOptions("tcp", "127.0.0.1:29132", MsgTypeMsg, &DefMsgHandler{}, nil, nil, opts)
+	defer c.Stop()
+	ca, cb := make(chan *Message, 1), make(chan *Message, 1)
+	c.SendCallback(a, ca)
+	c.SendCallback(b, cb)
+	for _, w := range []struct {
+		c    chan *Message
+		id   uint32
+		data string
+	}{{ca, 0x10001, "a"}, {cb, 0x20001, "b"}} {
+		select {
+		case m := <-w.c:
+			if m == nil || m.Id32() != w.id || string(m.Data) != w.data {
+				t.Fatal("callback", w.id, m)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout", w.id)
+		}
+	}
+
+	//交错到达的分片分别重组
+	sender := &msgQue{packetSize: 100}
+	var frags [2][]*Message
+	for i, id := range []uint32{0x10001, 0x20001} {
+		sender.cwrite = make(chan *Message, 8)
+		sender.sendFragment(NewMsg32(id, 0, bytes.Repeat([]byte{byte(i)}, 200)))
+		close(sender.cwrite)
+		for m := range sender.cwrite {
+			frags[i] = append(frags[i], m)
+		}
+	}
+	q := &msgQue{}
+	var got []*Message
+	for i := range frags[0] {
+		for j := range frags {
+			if m, ok := q.reassemble(frags[j][i]); !ok {
+				t.Fatal("reassemble failed")
+			} else if m != nil {
+				got = append(got, m)
+			}
+		}
+	}
+	if len(got) != 2 || got[0].Id32() != 0x10001 || got[1].Id32() != 0x20001 || len(got[0].Data) != 200 || got[1].Data[0] != 1 {
+		t.Fatal("fragments", len(got))
+	}
+}
+
+//缓冲区足够时编码消息头不分配内存
+func TestEncodeHeadNoAlloc(t *testing.T) {
+	head := &MessageHead{Len: 5, Id: 1}
+	data := []byte("hello")
+	buf := make([]byte, 0, 64)
+	for _, c := range []IHeadCodec{&DefHeadCodec{}, &VarintHeadCodec{}, &Id32HeadCodec{}, &CrcHeadCodec{}} {
+		if n := testing.AllocsPerRun(100, func() { c.EncodeHead(buf, head, data) }); n != 0 {
+			t.Fatalf("%T allocs:%v", c, n)
+		}
+	}
+}
+
+//rudp分片按消息头编码器的消息头长度计算，分片加消息头不超过消息长度限制
+func TestUdpFragmentHeadCodec(t *testing.T) {
+	q := &udpMsgQue{}
+	q.setReliable(true)
+	for _, c := range []IHeadCodec{&DefHeadCodec{}, &VarintHeadCodec{}, &Id32HeadCodec{}, &CrcHeadCodec{}} {
+		q.SetHeadCodec(c)
+		if size := int(q.getFragmentSize()) + c.MaxHeadSize(); size != RudpMaxMsgSize {
+			t.Fatalf("%T packet size:%v", c, size)
+		}
+	}
+
+	opts := &MsgQueOptions{HeadCodec: &CrcHeadCodec{}}
+	if err := StartServerWithOptions("rudp://127.0.0.1:29131", MsgTypeMsg, &testEchoHandler{}, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	h := &testRecvHandler{got: make(chan *Message, 1)}
+	c := StartConnectWithOptions("rudp", "127.0.0.1:29131", MsgTypeMsg, h, nil, nil, opts)
+	defer c.Stop()
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	c.Send(NewMsg(1, 2, data))
+	select {
+	case m := <-h.got:
+		if !bytes.Equal(m.Data, data) {
+			t.Fatalf("len:%v", len(m.Data))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout")
+	}
+}
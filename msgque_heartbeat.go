@@ -0,0 +1,146 @@
+/*
+@Time       : 2022/7/10
+@Author     : wuqiusheng
+@File       : msgque_heartbeat.go
+@Description: 心跳，使用保留的消息ID，开启心跳时不会交给消息处理器
+			Index 0为ping，1为pong，数据为发送ping时的时间戳(ms)，pong原样返回用于计算延迟
+			双方都需要开启心跳，收到ping自动回应，定时发送ping，连续HeartbeatMiss个间隔没有收到pong时关闭连接
+			未开启心跳的消息队列收到的心跳消息作为普通消息处理
+*/
+package easynet
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MsgIdHeartbeat uint16 = 0xFFFE //心跳消息ID，保留，开启心跳时不会交给消息处理器
+
+	heartbeatPing uint16 = 0
+	heartbeatPong uint16 = 1
+)
+
+var heartbeatOnce sync.Once
+
+//设置心跳间隔 s，0表示关闭，未设置时使用Config.HeartbeatInterval
+func (r *msgQue) SetHeartbeat(interval int) {
+	if interval > 0 {
+		atomic.StoreInt32(&r.heartbeat, int32(interval))
+		startHeartbeat()
+	} else {
+		atomic.StoreInt32(&r.heartbeat, -1)
+	}
+}
+
+func (r *msgQue) getHeartbeat() int {
+	if heartbeat := atomic.LoadInt32(&r.heartbeat); heartbeat != 0 {
+		return int(heartbeat)
+	}
+	return Config.HeartbeatInterval
+}
+
+//最近一次心跳的往返时间 ms
+func (r *msgQue) RTT() int64 {
+	return atomic.LoadInt64(&r.rtt)
+}
+
+//最近一次收到pong的时间 ms，没有收到过pong时为0
+func (r *msgQue) LastPong() int64 {
+	return atomic.LoadInt64(&r.lastPong)
+}
+
+func newHeartbeatMsg(index uint16, ts int64) *Message {
+	data := make([]byte, 8)
+	msgHeadByteOrder.PutUint64(data, uint64(ts))
+	return NewMsg(MsgIdHeartbeat, index, data)
+}
+
+func (r *msgQue) onHeartbeat(msg *Message) bool {
+	if len(msg.Data) != 8 {
+		LogError("[msgque]heartbeat data invalid msgque:%v len:%v", r.id, len(msg.Data))
+		return false
+	}
+	if msg.Head.Index == heartbeatPing {
+		r.pushWrite(NewMsg(MsgIdHeartbeat, heartbeatPong, append([]byte(nil), msg.Data...)))
+		msg.Release()
+		return true
+	}
+	ts := int64(msgHeadByteOrder.Uint64(msg.Data))
+	msg.Release()
+	now := UnixMs()
+	if ts > 0 && ts <= now {
+		atomic.StoreInt64(&r.rtt, now-ts)
+	}
+	atomic.StoreInt64(&r.lastPong, now)
+	return true
+}
+
+//由心跳协程定时调用
+func (r *msgQue) heartbeatTick(now int64) {
+	interval := int64(r.getHeartbeat()) * 1000
+	if interval <= 0 || r.msgTyp != MsgTypeMsg || r.connTyp == ConnTypeListen || r.stop == 1 {
+		return
+	}
+	if r.session != nil && r.connTyp == ConnTypeAccept && r.session.getTransport() != r {
+		//会话由其他连接承载，心跳由该连接处理
+		return
+	}
+	if !r.available {
+		//重连后重新计算
+		atomic.StoreInt64(&r.lastPong, 0)
+		atomic.StoreInt64(&r.pingStart, 0)
+		return
+	}
+	//没有收到过pong时从开始发送心跳的时间计算超时
+	last := atomic.LoadInt64(&r.lastPong)
+	if last == 0 {
+		if last = atomic.LoadInt64(&r.pingStart); last == 0 {
+			last = now
+			atomic.StoreInt64(&r.pingStart, now)
+		}
+	}
+	if miss := int64(Config.HeartbeatMiss); miss > 0 && now-last > interval*miss {
+		LogInfo("[msgque] close because heartbeat timeout id:%v lastPong:%v", r.id, atomic.LoadInt64(&r.lastPong))
+		if msgque := r.getMsgQue(); msgque != nil {
+			msgque.Stop()
+		}
+		return
+	}
+	if now-atomic.LoadInt64(&r.lastPing) >= interval {
+		atomic.StoreInt64(&r.lastPing, now)
+		func() {
+			defer func() {
+				recover() //写入通道可能已经关闭
+			}()
+			r.pushWrite(newHeartbeatMsg(heartbeatPing, now))
+		}()
+	}
+}
+
+func startHeartbeat() {
+	heartbeatOnce.Do(func() {
+		Go2(func(cstop chan struct{}) {
+			tick := time.NewTicker(time.Second)
+			defer tick.Stop()
+			for IsRuning() {
+				select {
+				case <-cstop:
+					return
+				case <-tick.C:
+					now := UnixMs()
+					var list []IMsgQue
+					msgqueMapSync.Lock()
+					for _, msgque := range msgqueMap {
+						list = append(list, msgque)
+					}
+					msgqueMapSync.Unlock()
+					for _, msgque := range list {
+						msgque.heartbeatTick(now)
+					}
+				}
+			}
+		})
+	})
+}
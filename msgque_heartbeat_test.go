@@ -0,0 +1,77 @@
+package easynet
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//记录收到的消息ID
+type testIdHandler struct {
+	DefMsgHandler
+	ids chan uint16
+}
+
+func (r *testIdHandler) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	select {
+	case r.ids <- msg.Id():
+	default:
+	}
+	return true
+}
+
+//双方开启心跳，自动回应pong并记录延迟，心跳消息不交给消息处理器
+func TestHeartbeatPong(t *testing.T) {
+	s := &testIdHandler{ids: make(chan uint16, 8)}
+	if err := StartServerWithOptions("tcp://127.0.0.1:29201", MsgTypeMsg, s, nil, &MsgQueOptions{Heartbeat: 1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	h := &testIdHandler{ids: make(chan uint16, 8)}
+	c := StartConnect("tcp", "127.0.0.1:29201", MsgTypeMsg, h, nil, nil)
+	defer c.Stop()
+	c.SetHeartbeat(1)
+	for i := 0; i < 150 && c.LastPong() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if c.LastPong() == 0 || c.RTT() < 0 || c.RTT() > 1000 {
+		t.Fatal("no pong", c.LastPong(), c.RTT())
+	}
+	select {
+	case id := <-s.ids:
+		t.Fatal("server handler got", id)
+	case id := <-h.ids:
+		t.Fatal("client handler got", id)
+	default:
+	}
+}
+
+//连续HeartbeatMiss个间隔没有收到pong时关闭连接，收到pong后重新计算
+func TestHeartbeatMiss(t *testing.T) {
+	old := Config.HeartbeatMiss
+	Config.HeartbeatMiss = 2
+	defer func() { Config.HeartbeatMiss = old }()
+	q := newTcpConn("tcp", "127.0.0.1:1", nil, MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+	defer q.Stop()
+	atomic.StoreInt32(&q.heartbeat, 1)
+	q.available = true
+
+	now := UnixMs()
+	q.heartbeatTick(now)
+	if m := <-q.cwrite; m.Id() != MsgIdHeartbeat || m.Index() != heartbeatPing {
+		t.Fatal("ping", m.Id(), m.Index())
+	}
+	q.heartbeatTick(now + 1000)
+	<-q.cwrite
+	if !q.onHeartbeat(newHeartbeatMsg(heartbeatPong, now)) || q.LastPong() == 0 {
+		t.Fatal("pong")
+	}
+	q.heartbeatTick(now + 2000)
+	if q.IsStop() {
+		t.Fatal("closed after pong")
+	}
+	q.heartbeatTick(q.LastPong() + 2001)
+	if !q.IsStop() {
+		t.Fatal("not closed after miss")
+	}
+}
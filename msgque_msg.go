@@ -3,66 +3,96 @@
 @Author     : wuqiusheng
 @File       : msgque_msg.go
 @Description: 消息头，消息
+			消息头固定9字节，字节序默认小端，可通过SetMsgHeadByteOrder设置
+			偏移 0:Len(uint32) 4:Id(uint16) 6:Index(uint16) 8:Flags(uint8)
+			超长消息拆分为带FlagContinue的分片，分片数据前有8字节分片头，字节序与消息头一致
+			偏移 0:Serial(uint32) 4:Index(uint16) 6:Total(uint16)
 */
 package easynet
 
 import (
 	"easyutil"
-	"unsafe"
+	"encoding/binary"
 )
 
 const (
-	MsgHeadSize = 9
+	MsgHeadSize      = 9
+	fragmentHeadSize = 8
 )
 
 const (
 	FlagEncrypt  = 1 << 0 //数据是经过加密的
 	FlagCompress = 1 << 1 //数据是经过压缩的
-	//FlagContinue = 1 << 2 //消息还有后续
-	//FlagNeedAck  = 1 << 3 //消息需要确认
-	//FlagAck      = 1 << 4 //确认消息
-	//FlagReSend   = 1 << 5 //重发消息
-	//FlagClient   = 1 << 6 //消息来自客服端，用于判断index来之服务器还是其他玩家
+	FlagContinue = 1 << 2 //分片消息，数据前有分片头
+	FlagNeedAck  = 1 << 3 //消息需要确认
+	FlagAck      = 1 << 4 //确认消息
+	FlagReSend   = 1 << 5 //重发消息
+	FlagResume   = 1 << 6 //消息计入会话恢复的序号
+	FlagCodec    = 1 << 7 //压缩数据首字节为压缩算法id，与FlagCompress一起使用
 )
 
+var msgHeadByteOrder binary.ByteOrder = binary.LittleEndian
+
+//设置消息头字节序，需要在消息队列启动前设置，通讯双方必须一致
+func SetMsgHeadByteOrder(order binary.ByteOrder) {
+	msgHeadByteOrder = order
+}
+
+func GetMsgHeadByteOrder() binary.ByteOrder {
+	return msgHeadByteOrder
+}
+
 var MaxMsgDataSize uint32 = 1024 * 1024
+var MaxReassembleSize uint32 = 16 * 1024 * 1024 //分片消息重组后的最大长度，所有未完成的分片共享
+
+//接收中的分片消息
+type msgFragment struct {
+	serial uint32            //发送方的分片消息序号
+	total  uint16            //分片数量
+	chunks map[uint16][]byte //已收到的分片，key为分片序号
+	size   uint32            //已收到的分片长度，包含分片头
+}
 
 type MessageHead struct {
 	Len   uint32 //数据长度
 	Id    uint16 //消息ID
 	Index uint16 //序号
 	Flags uint8  //标记
+	IdExt uint16 //32位消息ID的高16位，只有Id32HeadCodec会传输
+
+	data  []byte
+	check uint32 //消息头中的校验值，由IHeadCodec使用
+}
 
-	data []byte
+func (r *MessageHead) encode(order binary.ByteOrder, data []byte) {
+	order.PutUint32(data, r.Len)
+	order.PutUint16(data[4:], r.Id)
+	order.PutUint16(data[6:], r.Index)
+	data[8] = r.Flags
+}
+
+func (r *MessageHead) decode(order binary.ByteOrder, data []byte) {
+	r.Len = order.Uint32(data)
+	r.Id = order.Uint16(data[4:])
+	r.Index = order.Uint16(data[6:])
+	r.Flags = data[8]
 }
 
 func (r *MessageHead) Bytes() []byte {
 	r.data = make([]byte, MsgHeadSize)
-	phead := (*MessageHead)(unsafe.Pointer(&r.data[0]))
-	phead.Len = r.Len
-	phead.Id = r.Id
-	phead.Index = r.Index
-	phead.Flags = r.Flags
+	r.encode(msgHeadByteOrder, r.data)
 	return r.data
 }
 
 func (r *MessageHead) FastBytes(data []byte) []byte {
-	phead := (*MessageHead)(unsafe.Pointer(&data[0]))
-	phead.Len = r.Len
-	phead.Id = r.Id
-	phead.Index = r.Index
-	phead.Flags = r.Flags
+	r.encode(msgHeadByteOrder, data)
 	return data
 }
 
 func (r *MessageHead) BytesWithData(wdata []byte) []byte {
 	r.Len = uint32(len(wdata))
 	r.data = make([]byte, MsgHeadSize+r.Len)
-	phead := (*MessageHead)(unsafe.Pointer(&r.data[0]))
-	phead.Len = r.Len
-	phead.Id = r.Id
-	phead.Index = r.Index
-	phead.Flags = r.Flags
+	r.encode(msgHeadByteOrder, r.data)
 	if wdata != nil {
 		copy(r.data[MsgHeadSize:], wdata)
 	}
@@ -73,21 +103,28 @@ func (r *MessageHead) FromBytes(data []byte) error {
 	if len(data) < MsgHeadSize {
 		return ErrMsgLenTooShort
 	}
-	phead := (*MessageHead)(unsafe.Pointer(&data[0]))
-	r.Len = phead.Len
-	r.Id = phead.Id
-	r.Index = phead.Index
-	r.Flags = phead.Flags
+	r.decode(msgHeadByteOrder, data)
 	if r.Len > MaxMsgDataSize {
 		return ErrMsgLenTooLong
 	}
 	return nil
 }
 
+//由Id和Index组成，不包含IdExt，消息队列内部的请求回应和分片重组使用包含IdExt的tagKey
 func (r *MessageHead) Tag() uint32 {
 	return Tag(r.Id, r.Index)
 }
 
+//包含IdExt的Tag，32位消息ID只有高16位不同时也不会冲突
+func (r *MessageHead) tagKey() uint64 {
+	return uint64(r.IdExt)<<32 | uint64(r.Tag())
+}
+
+//32位消息ID，高16位为IdExt，低16位为Id
+func (r *MessageHead) Id32() uint32 {
+	return uint32(r.IdExt)<<16 | uint32(r.Id)
+}
+
 func (r *MessageHead) String() string {
 	return easyutil.Sprintf("Len:%v Id:%v Index:%v Flags:%v",
 		r.Len, r.Id, r.Index, r.Flags)
@@ -102,15 +139,7 @@ func NewMessageHead(data []byte) *MessageHead {
 }
 
 func MessageHeadFromByte(data []byte) *MessageHead {
-	if len(data) < MsgHeadSize {
-		return nil
-	}
-	phead := new(*MessageHead)
-	*phead = (*MessageHead)(unsafe.Pointer(&data[0]))
-	if (*phead).Len > MaxMsgDataSize {
-		return nil
-	}
-	return *phead
+	return NewMessageHead(data)
 }
 
 type Message struct {
@@ -118,6 +147,8 @@ type Message struct {
 	Data       []byte       //消息数据
 	IMsgParser              //消息解析器
 	User       interface{}  //用户自定义数据
+
+	buf *msgBuffer //使用缓冲区池时Data所在的缓冲区
 }
 
 func (r *Message) Len() uint32 {
@@ -134,6 +165,13 @@ func (r *Message) Id() uint16 {
 	return 0
 }
 
+func (r *Message) Id32() uint32 {
+	if r.Head != nil {
+		return r.Head.Id32()
+	}
+	return 0
+}
+
 func (r *Message) Index() uint16 {
 	if r.Head != nil {
 		return r.Head.Index
@@ -155,6 +193,13 @@ func (r *Message) Tag() uint32 {
 	return 0
 }
 
+func (r *Message) tagKey() uint64 {
+	if r.Head != nil {
+		return r.Head.tagKey()
+	}
+	return 0
+}
+
 func (r *Message) Bytes() []byte {
 	if r.Head != nil {
 		if r.Data != nil {
@@ -169,6 +214,7 @@ func (r *Message) CopyTag(old *Message) *Message {
 	if r.Head != nil && old.Head != nil {
 		r.Head.Id = old.Head.Id
 		r.Head.Index = old.Head.Index
+		r.Head.IdExt = old.Head.IdExt
 	}
 	return r
 }
@@ -199,6 +245,13 @@ func NewMsg(id, index uint16, data []byte) *Message {
 	}
 }
 
+//32位消息ID的消息，配合Id32HeadCodec使用
+func NewMsg32(id uint32, index uint16, data []byte) *Message {
+	msg := NewMsg(uint16(id), index, data)
+	msg.Head.IdExt = uint16(id >> 16)
+	return msg
+}
+
 func NewTagMsg(id uint16, index uint16) *Message {
 	return &Message{
 		Head: &MessageHead{
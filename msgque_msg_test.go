@@ -0,0 +1,60 @@
+package easynet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+//消息头编解码与标准字节一致
+func TestMsgHeadGolden(t *testing.T) {
+	defer SetMsgHeadByteOrder(GetMsgHeadByteOrder())
+	cases := []struct {
+		order  binary.ByteOrder
+		head   MessageHead
+		golden []byte
+	}{
+		{binary.LittleEndian, MessageHead{Len: 0x00020304, Id: 0x0506, Index: 0x0708, Flags: 0x09}, []byte{0x04, 0x03, 0x02, 0x00, 0x06, 0x05, 0x08, 0x07, 0x09}},
+		{binary.LittleEndian, MessageHead{Len: 3, Id: 1, Index: 2, Flags: FlagCompress | FlagContinue}, []byte{0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x02, 0x00, 0x06}},
+		{binary.LittleEndian, MessageHead{Len: 0, Id: 0xFFFF, Index: 0xFFFF, Flags: 0xFF}, []byte{0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{binary.BigEndian, MessageHead{Len: 0x00020304, Id: 0x0506, Index: 0x0708, Flags: 0x09}, []byte{0x00, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}},
+		{binary.BigEndian, MessageHead{Len: 3, Id: 1, Index: 2, Flags: FlagCompress | FlagContinue}, []byte{0x00, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00, 0x02, 0x06}},
+		{binary.BigEndian, MessageHead{Len: 0, Id: 0xFFFF, Index: 0xFFFF, Flags: 0xFF}, []byte{0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+	for i, c := range cases {
+		SetMsgHeadByteOrder(c.order)
+		head := c.head
+		if data := head.Bytes(); !bytes.Equal(data, c.golden) {
+			t.Fatalf("case %d encode %x golden %x", i, data, c.golden)
+		}
+		if data := head.FastBytes(make([]byte, MsgHeadSize)); !bytes.Equal(data, c.golden) {
+			t.Fatalf("case %d fast encode %x golden %x", i, data, c.golden)
+		}
+		nhead := NewMessageHead(c.golden)
+		if nhead == nil || nhead.Len != head.Len || nhead.Id != head.Id || nhead.Index != head.Index || nhead.Flags != head.Flags {
+			t.Fatalf("case %d decode %v", i, nhead)
+		}
+	}
+}
+
+func TestMsgBytesGolden(t *testing.T) {
+	defer SetMsgHeadByteOrder(GetMsgHeadByteOrder())
+	cases := []struct {
+		order  binary.ByteOrder
+		golden []byte
+	}{
+		{binary.LittleEndian, []byte{0x02, 0x00, 0x00, 0x00, 0x34, 0x12, 0x01, 0x00, 0x00, 'o', 'k'}},
+		{binary.BigEndian, []byte{0x00, 0x00, 0x00, 0x02, 0x12, 0x34, 0x00, 0x01, 0x00, 'o', 'k'}},
+	}
+	for i, c := range cases {
+		SetMsgHeadByteOrder(c.order)
+		if data := NewMsg(0x1234, 1, []byte("ok")).Bytes(); !bytes.Equal(data, c.golden) {
+			t.Fatalf("case %d encode %x golden %x", i, data, c.golden)
+		}
+		q := &msgQue{}
+		m, err := q.decodeMsg(c.golden)
+		if err != nil || m.Head.Id != 0x1234 || m.Head.Index != 1 || string(m.Data) != "ok" {
+			t.Fatalf("case %d decode %v %v", i, m, err)
+		}
+	}
+}
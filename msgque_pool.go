@@ -0,0 +1,364 @@
+/*
+@Time       : 2022/7/14
+@Author     : wuqiusheng
+@File       : msgque_pool.go
+@Description: 客户端连接池，对多个地址各保持多条连接，按负载均衡策略选择可用连接
+			连接失败或断开后从可用列表中移除，按重连策略重连，成功后重新加入，不再重连的连接从连接池中删除
+			连接池不使用消息队列的用户数据，调用者可以自由使用SetUser和GetUser
+			BalanceHash使用一致性哈希，地址不可用时顺延到哈希环上的下一个地址
+			地址可通过AddAddr和RemoveAddr动态增减，用于服务发现
+*/
+package easynet
+
+import (
+	"context"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+type BalanceType int
+
+const (
+	BalanceRoundRobin   BalanceType = iota //轮询
+	BalanceLeastPending                    //等待发送和等待回应最少的连接
+	BalanceHash                            //按key一致性哈希
+)
+
+const poolHashReplicas = 100 //每个地址在哈希环上的虚拟节点数
+
+var DefPoolReconnect = &ReconnectPolicy{MinDelay: 1000, MaxDelay: 30000, Jitter: 0.2}
+
+type poolEndpoint struct {
+	addr    string
+	msgques []IMsgQue
+	healthy map[uint32]IMsgQue
+	removed bool
+}
+
+type MsgQuePool struct {
+	netType   string
+	count     int
+	typ       MsgType
+	handler   IMsgHandler
+	parser    IParserFactory
+	opts      *MsgQueOptions
+	balance   BalanceType
+	endpoints []*poolEndpoint
+	ring      []uint32                 //哈希环
+	ringMap   map[uint32]*poolEndpoint //哈希值对应的地址
+	healthy   []IMsgQue                //可用连接
+	epMap     map[uint32]*poolEndpoint //消息队列id对应的地址
+	early     map[uint32]bool          //加入连接池前的连接结果，true为已连接，false为已关闭
+	next      uint32
+	lock      sync.RWMutex
+}
+
+//连接池的消息处理器，根据连接结果维护可用列表
+type poolHandler struct {
+	IMsgHandler
+	pool *MsgQuePool
+}
+
+func (r *poolHandler) OnConnectComplete(msgque IMsgQue, ok bool) bool {
+	re := r.IMsgHandler.OnConnectComplete(msgque, ok)
+	if ok && re {
+		r.pool.setHealthy(msgque, true)
+	}
+	return re
+}
+
+func (r *poolHandler) OnDelMsgQue(msgque IMsgQue) {
+	if msgque.willReconnect() {
+		r.pool.setHealthy(msgque, false)
+	} else {
+		r.pool.remove(msgque)
+	}
+	r.IMsgHandler.OnDelMsgQue(msgque)
+}
+
+//嵌入的消息处理器是接口，需要转发可选接口
+func (r *poolHandler) OnSendHighWater(msgque IMsgQue, pending int) {
+	if handler, ok := r.IMsgHandler.(ISendHighWaterHandler); ok {
+		handler.OnSendHighWater(msgque, pending)
+	}
+}
+
+/*
+	创建连接池
+	netType 同StartConnect
+	count 每个地址的连接数
+	opts.Reconnect为nil时使用DefPoolReconnect
+*/
+func NewMsgQuePool(netType string, addrs []string, count int, balance BalanceType, typ MsgType, handler IMsgHandler, parser IParserFactory, opts *MsgQueOptions) *MsgQuePool {
+	if count < 1 {
+		count = 1
+	}
+	if opts == nil {
+		opts = &MsgQueOptions{}
+	}
+	if opts.Reconnect == nil {
+		o := *opts
+		o.Reconnect = DefPoolReconnect
+		opts = &o
+	}
+	pool := &MsgQuePool{
+		netType: netType,
+		count:   count,
+		typ:     typ,
+		parser:  parser,
+		opts:    opts,
+		balance: balance,
+		ringMap: map[uint32]*poolEndpoint{},
+		epMap:   map[uint32]*poolEndpoint{},
+		early:   map[uint32]bool{},
+	}
+	pool.handler = &poolHandler{IMsgHandler: handler, pool: pool}
+	for _, addr := range addrs {
+		pool.AddAddr(addr)
+	}
+	return pool
+}
+
+//增加地址并建立连接，地址已存在时返回false
+func (r *MsgQuePool) AddAddr(addr string) bool {
+	r.lock.Lock()
+	for _, ep := range r.endpoints {
+		if ep.addr == addr {
+			r.lock.Unlock()
+			return false
+		}
+	}
+	ep := &poolEndpoint{addr: addr, healthy: map[uint32]IMsgQue{}}
+	r.endpoints = append(r.endpoints, ep)
+	r.buildRing()
+	r.lock.Unlock()
+
+	for i := 0; i < r.count; i++ {
+		msgque := StartConnectWithOptions(r.netType, addr, r.typ, r.handler, r.parser, nil, r.opts)
+		if msgque == nil {
+			continue
+		}
+		r.lock.Lock()
+		connected, early := r.early[msgque.Id()]
+		delete(r.early, msgque.Id())
+		if early && !connected {
+			//加入前已经关闭且不再重连
+			r.lock.Unlock()
+			continue
+		}
+		ep.msgques = append(ep.msgques, msgque)
+		r.epMap[msgque.Id()] = ep
+		removed := ep.removed
+		if connected && !removed {
+			ep.healthy[msgque.Id()] = msgque
+			r.buildHealthy()
+		}
+		r.lock.Unlock()
+		if removed {
+			msgque.Close()
+		}
+	}
+	return true
+}
+
+//移除地址并关闭其所有连接，地址不存在时返回false
+func (r *MsgQuePool) RemoveAddr(addr string) bool {
+	r.lock.Lock()
+	var ep *poolEndpoint
+	for i, e := range r.endpoints {
+		if e.addr == addr {
+			ep = e
+			r.endpoints = append(r.endpoints[:i], r.endpoints[i+1:]...)
+			break
+		}
+	}
+	if ep == nil {
+		r.lock.Unlock()
+		return false
+	}
+	ep.removed = true
+	ep.healthy = map[uint32]IMsgQue{}
+	r.buildRing()
+	r.buildHealthy()
+	list := append([]IMsgQue{}, ep.msgques...)
+	r.lock.Unlock()
+
+	for _, msgque := range list {
+		msgque.Close()
+	}
+	return true
+}
+
+//当前的地址列表
+func (r *MsgQuePool) Addrs() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	addrs := make([]string, 0, len(r.endpoints))
+	for _, ep := range r.endpoints {
+		addrs = append(addrs, ep.addr)
+	}
+	return addrs
+}
+
+//重建哈希环，需要持有写锁
+func (r *MsgQuePool) buildRing() {
+	r.ring = r.ring[:0]
+	r.ringMap = map[uint32]*poolEndpoint{}
+	for _, ep := range r.endpoints {
+		for j := 0; j < poolHashReplicas; j++ {
+			hash := crc32.ChecksumIEEE([]byte(ep.addr + "#" + strconv.Itoa(j)))
+			if _, ok := r.ringMap[hash]; !ok {
+				r.ringMap[hash] = ep
+				r.ring = append(r.ring, hash)
+			}
+		}
+	}
+	sort.Slice(r.ring, func(i, j int) bool { return r.ring[i] < r.ring[j] })
+}
+
+//重建可用连接列表，需要持有写锁
+func (r *MsgQuePool) buildHealthy() {
+	r.healthy = r.healthy[:0]
+	for _, e := range r.endpoints {
+		for _, q := range e.healthy {
+			r.healthy = append(r.healthy, q)
+		}
+	}
+}
+
+func (r *MsgQuePool) setHealthy(msgque IMsgQue, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ep := r.epMap[msgque.Id()]
+	if ep == nil {
+		//连接成功回调可能早于加入连接池，加入时处理
+		r.early[msgque.Id()] = ok
+		return
+	}
+	if ok && !ep.removed {
+		ep.healthy[msgque.Id()] = msgque
+	} else {
+		delete(ep.healthy, msgque.Id())
+	}
+	r.buildHealthy()
+}
+
+//从连接池中删除不再重连的连接
+func (r *MsgQuePool) remove(msgque IMsgQue) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	id := msgque.Id()
+	ep := r.epMap[id]
+	if ep == nil {
+		r.early[id] = false
+		return
+	}
+	delete(r.epMap, id)
+	delete(ep.healthy, id)
+	for i, q := range ep.msgques {
+		if q.Id() == id {
+			ep.msgques = append(ep.msgques[:i], ep.msgques[i+1:]...)
+			break
+		}
+	}
+	r.buildHealthy()
+}
+
+//可用连接数量
+func (r *MsgQuePool) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.healthy)
+}
+
+//按负载均衡策略获取可用连接，key仅用于BalanceHash，没有可用连接时返回nil
+func (r *MsgQuePool) Get(key string) IMsgQue {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if len(r.healthy) == 0 {
+		return nil
+	}
+	switch r.balance {
+	case BalanceLeastPending:
+		var best IMsgQue
+		min := -1
+		for _, msgque := range r.healthy {
+			if pending := msgque.Pending(); min < 0 || pending < min {
+				best, min = msgque, pending
+			}
+		}
+		return best
+	case BalanceHash:
+		hash := crc32.ChecksumIEEE([]byte(key))
+		pos := sort.Search(len(r.ring), func(i int) bool { return r.ring[i] >= hash })
+		for i := 0; i < len(r.ring); i++ {
+			ep := r.ringMap[r.ring[(pos+i)%len(r.ring)]]
+			if len(ep.healthy) == 0 {
+				continue
+			}
+			//同一地址的多条连接按key固定选择
+			idx := int(hash % uint32(len(ep.healthy)))
+			for _, msgque := range ep.msgques {
+				if _, ok := ep.healthy[msgque.Id()]; ok {
+					if idx == 0 {
+						return msgque
+					}
+					idx--
+				}
+			}
+		}
+		return nil
+	}
+	n := atomic.AddUint32(&r.next, 1)
+	return r.healthy[n%uint32(len(r.healthy))]
+}
+
+func (r *MsgQuePool) Send(m *Message) bool {
+	return r.SendKey("", m)
+}
+
+func (r *MsgQuePool) SendKey(key string, m *Message) bool {
+	if msgque := r.Get(key); msgque != nil {
+		return msgque.Send(m)
+	}
+	return false
+}
+
+func (r *MsgQuePool) Call(ctx context.Context, m *Message) (*Message, error) {
+	return r.CallKey(ctx, "", m)
+}
+
+func (r *MsgQuePool) CallKey(ctx context.Context, key string, m *Message) (*Message, error) {
+	if msgque := r.Get(key); msgque != nil {
+		return msgque.Call(ctx, m)
+	}
+	return nil, ErrNetUnreachable
+}
+
+func (r *MsgQuePool) CallAsync(m *Message, cb func(*Message, error)) {
+	r.CallAsyncKey("", m, cb)
+}
+
+func (r *MsgQuePool) CallAsyncKey(key string, m *Message, cb func(*Message, error)) {
+	if msgque := r.Get(key); msgque != nil {
+		msgque.CallAsync(m, cb)
+	} else {
+		cb(nil, ErrNetUnreachable)
+	}
+}
+
+//关闭所有连接，不再重连
+func (r *MsgQuePool) Close() {
+	r.lock.RLock()
+	var list []IMsgQue
+	for _, ep := range r.endpoints {
+		list = append(list, ep.msgques...)
+	}
+	r.lock.RUnlock()
+	for _, msgque := range list {
+		msgque.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package easynet
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//连接池不占用用户数据，关闭后删除所有连接
+func TestMsgQuePoolClose(t *testing.T) {
+	if err := StartServer("tcp://127.0.0.1:29151", MsgTypeMsg, &testEchoHandler{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	pool := NewMsgQuePool("tcp", []string{"127.0.0.1:29151"}, 2, BalanceRoundRobin, MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+	for i := 0; i < 50 && pool.Len() < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if pool.Len() != 2 {
+		t.Fatal("healthy:", pool.Len())
+	}
+	q := pool.Get("")
+	if q.GetUser() != nil {
+		t.Fatal("user:", q.GetUser())
+	}
+	q.SetUser("user")
+	if pool.Get("") == nil || q.GetUser() != "user" {
+		t.Fatal("user not kept")
+	}
+
+	pool.Close()
+	for i := 0; i < 50; i++ {
+		pool.lock.RLock()
+		n := len(pool.epMap) + len(pool.endpoints[0].msgques)
+		pool.lock.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+	if len(pool.epMap) != 0 || len(pool.endpoints[0].msgques) != 0 || len(pool.healthy) != 0 || len(pool.early) != 0 {
+		t.Fatal("not removed", len(pool.epMap), len(pool.endpoints[0].msgques), len(pool.healthy), len(pool.early))
+	}
+}
+
+//连接池的消息处理器转发高水位回调
+func TestPoolHandlerHighWater(t *testing.T) {
+	for _, h := range []IMsgHandler{&testHighWaterHandler{}, &DefMsgHandler{}} {
+		q := newTcpConn("tcp", "127.0.0.1:1", nil, MsgTypeMsg, &poolHandler{IMsgHandler: h}, nil, nil)
+		q.SetHighWater(2)
+		for i := 0; i < 3; i++ {
+			q.Send(NewMsg(1, 0, nil))
+		}
+		q.Stop()
+		if hw, ok := h.(*testHighWaterHandler); ok && atomic.LoadInt32(&hw.hits) != 1 {
+			t.Fatal("hits", hw.hits)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+@Time       : 2022/8/2
+@Author     : wuqiusheng
+@File       : msgque_proxy.go
+@Description: tcp监听解析HAProxy PROXY protocol v1/v2头，自动设置客户端真实地址
+			只解析可信来源的连接，可信来源必须发送PROXY头，否则关闭连接
+			默认不信任任何来源，需要通过Trusted指定可信地址，或设置TrustAll信任所有来源
+			v2的LOCAL命令(代理健康检查)和UNKNOWN协议保留连接地址
+*/
+package easynet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyV1MaxLen = 107 //v1头最大长度，包括\r\n
+
+//PROXY protocol参数
+type ProxyProtocol struct {
+	Trusted  []string //可信的代理地址，CIDR或IP
+	TrustAll bool     //信任所有来源，只应在监听地址不对外暴露时使用
+	Timeout  int      //读取PROXY头的超时 ms，0表示5000
+
+	nets []*net.IPNet
+}
+
+//解析可信地址
+func (r *ProxyProtocol) init() error {
+	r.nets = r.nets[:0]
+	for _, s := range r.Trusted {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		r.nets = append(r.nets, n)
+	}
+	if len(r.nets) == 0 && !r.TrustAll {
+		return ErrProxyNoTrusted
+	}
+	return nil
+}
+
+func (r *ProxyProtocol) trusted(addr net.Addr) bool {
+	if r.TrustAll {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range r.nets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+//读取PROXY头，返回客户端真实地址，不可信来源或没有地址信息时返回空字符串
+func (r *ProxyProtocol) read(c net.Conn) (string, error) {
+	if !r.trusted(c.RemoteAddr()) {
+		return "", nil
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 5000
+	}
+	c.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout)))
+	defer c.SetReadDeadline(time.Time{})
+
+	head := make([]byte, 6)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return "", err
+	}
+	if string(head) == "PROXY " {
+		return readProxyV1(c)
+	}
+	if bytes.Equal(head, proxyV2Sig[:6]) {
+		return readProxyV2(c)
+	}
+	return "", ErrProxyProtocol
+}
+
+//PROXY TCP4 src dst sport dport\r\n
+func readProxyV1(c net.Conn) (string, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	b := make([]byte, 1)
+	for len(line) < proxyV1MaxLen-6 {
+		if _, err := io.ReadFull(c, b); err != nil {
+			return "", err
+		}
+		line = append(line, b[0])
+		if len(line) >= 2 && line[len(line)-2] == '\r' && line[len(line)-1] == '\n' {
+			break
+		}
+	}
+	if len(line) < 2 || line[len(line)-1] != '\n' {
+		return "", ErrProxyProtocol
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return "", nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return "", ErrProxyProtocol
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.Atoi(fields[3])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return "", ErrProxyProtocol
+	}
+	return net.JoinHostPort(ip.String(), fields[3]), nil
+}
+
+//签名(12) 版本命令(1) 协议(1) 长度(2) 地址
+func readProxyV2(c net.Conn) (string, error) {
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(head[:6], proxyV2Sig[6:]) || head[6]>>4 != 2 {
+		return "", ErrProxyProtocol
+	}
+	data := make([]byte, binary.BigEndian.Uint16(head[8:]))
+	if _, err := io.ReadFull(c, data); err != nil {
+		return "", err
+	}
+	if head[6]&0xF == 0 {
+		return "", nil
+	}
+	if head[6]&0xF != 1 {
+		return "", ErrProxyProtocol
+	}
+	var ip net.IP
+	var port uint16
+	switch head[7] >> 4 {
+	case 1:
+		if len(data) < 12 {
+			return "", ErrProxyProtocol
+		}
+		ip = net.IP(data[:4])
+		port = binary.BigEndian.Uint16(data[8:])
+	case 2:
+		if len(data) < 36 {
+			return "", ErrProxyProtocol
+		}
+		ip = net.IP(data[:16])
+		port = binary.BigEndian.Uint16(data[32:])
+	default:
+		return "", nil
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
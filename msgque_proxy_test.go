@@ -0,0 +1,84 @@
+package easynet
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+//默认不信任任何来源
+func TestProxyTrusted(t *testing.T) {
+	if err := (&ProxyProtocol{}).init(); err != ErrProxyNoTrusted {
+		t.Fatal("empty trusted list accepted", err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 1000}
+	p := &ProxyProtocol{Trusted: []string{"10.0.0.0/8", "192.168.1.3"}}
+	if err := p.init(); err != nil || p.trusted(addr) {
+		t.Fatal("untrusted addr accepted", err)
+	}
+	p = &ProxyProtocol{Trusted: []string{"192.168.1.0/24"}}
+	if err := p.init(); err != nil || !p.trusted(addr) {
+		t.Fatal("trusted addr rejected", err)
+	}
+	p = &ProxyProtocol{TrustAll: true}
+	if err := p.init(); err != nil || !p.trusted(addr) {
+		t.Fatal("trust all rejected", err)
+	}
+}
+
+//v2头，length为长度字段的值
+func testProxyV2(cmd, fam byte, length int, data []byte) []byte {
+	head := append(append([]byte(nil), proxyV2Sig...), 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(head[14:], uint16(length))
+	return append(head, data...)
+}
+
+//解析v1/v2头，截断、签名错误、过长和长度字段错误时返回错误
+func TestProxyRead(t *testing.T) {
+	tcp4 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x03, 0xE8, 0, 80}
+	tcp6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("::2").To16()...), 0x03, 0xE8, 0, 80)
+	badSig := testProxyV2(1, 0x11, 12, tcp4)
+	badSig[8] = 'X'
+	cases := []struct {
+		name string
+		data []byte
+		addr string
+		err  error
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000 80\r\n"), "1.2.3.4:1000", nil},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 ::2 1000 80\r\n"), "[2001:db8::1]:1000", nil},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", nil},
+		{"v1 truncated", []byte("PROXY TCP4 1.2.3.4"), "", io.EOF},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n"), "", ErrProxyProtocol},
+		{"v1 bad port", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 x 80\r\n"), "", ErrProxyProtocol},
+		{"v1 bad fields", []byte("PROXY TCP4 1.2.3.4\r\n"), "", ErrProxyProtocol},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", ErrProxyProtocol},
+		{"short", []byte("PRO"), "", io.ErrUnexpectedEOF},
+		{"v2 tcp4", testProxyV2(1, 0x11, 12, tcp4), "1.2.3.4:1000", nil},
+		{"v2 tcp6", testProxyV2(1, 0x21, 36, tcp6), "[2001:db8::1]:1000", nil},
+		{"v2 local", testProxyV2(0, 0, 0, nil), "", nil},
+		{"v2 local with addr", testProxyV2(0, 0x11, 12, tcp4), "", nil},
+		{"v2 unspec", testProxyV2(1, 0, 0, nil), "", nil},
+		{"v2 bad signature", badSig, "", ErrProxyProtocol},
+		{"v2 bad command", testProxyV2(2, 0x11, 12, tcp4), "", ErrProxyProtocol},
+		{"v2 truncated head", proxyV2Sig, "", io.ErrUnexpectedEOF},
+		{"v2 length too long", testProxyV2(1, 0x11, 20, tcp4), "", io.ErrUnexpectedEOF},
+		{"v2 length too short", testProxyV2(1, 0x11, 4, tcp4[:4]), "", ErrProxyProtocol},
+		{"v2 tcp6 length too short", testProxyV2(1, 0x21, 12, tcp4), "", ErrProxyProtocol},
+	}
+	p := &ProxyProtocol{TrustAll: true, Timeout: 1000}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func(data []byte) {
+			client.Write(data)
+			client.Close()
+		}(c.data)
+		addr, err := p.read(server)
+		server.Close()
+		if addr != c.addr || err != c.err {
+			t.Fatalf("%v addr:%v err:%v want addr:%v err:%v", c.name, addr, err, c.addr, c.err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+@Time       : 2022/7/12
+@Author     : wuqiusheng
+@File       : msgque_reconnect.go
+@Description: 重连策略，连接失败或断开后按指数退避自动重连，不需要在OnDelMsgQue中调用Reconnect
+			延迟为MinDelay*Factor^n，不超过MaxDelay，并随机减少Jitter比例，避免大量连接同时重连
+			MinDelay、MaxDelay未设置时使用默认值，避免立即重连导致的空转
+			断线期间发送的消息保留在写入通道中，重连成功后发出，超过MaxPending后丢弃新消息
+			调用Close关闭消息队列时不会重连，等待中的重连被取消
+*/
+package easynet
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defReconnectMinDelay = 1000  //默认首次重连延迟 ms
+	defReconnectMaxDelay = 60000 //默认最大重连延迟 ms
+)
+
+type ReconnectPolicy struct {
+	MinDelay    int                  //首次重连延迟 ms，0表示使用1s
+	MaxDelay    int                  //最大重连延迟 ms，0表示使用60s，不小于MinDelay
+	Factor      float64              //退避倍数，小于1时使用2
+	Jitter      float64              //随机抖动比例 [0,1]
+	MaxAttempts int                  //连续重连失败的最大次数，0表示不限制
+	MaxPending  int                  //断线期间保留的消息数量，0表示写入通道长度
+	OnGiveUp    func(msgque IMsgQue) //放弃重连时回调，之后消息队列关闭
+}
+
+func (r *ReconnectPolicy) delay(attempts int) int {
+	factor := r.Factor
+	if factor < 1 {
+		factor = 2
+	}
+	minDelay, maxDelay := r.MinDelay, r.MaxDelay
+	if minDelay <= 0 {
+		minDelay = defReconnectMinDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = defReconnectMaxDelay
+	}
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	d := float64(minDelay) * math.Pow(factor, float64(attempts))
+	if d > float64(maxDelay) {
+		d = float64(maxDelay)
+	}
+	if r.Jitter > 0 {
+		d -= d * math.Min(r.Jitter, 1) * rand.Float64()
+	}
+	return int(d)
+}
+
+//设置重连策略，nil表示不自动重连
+func (r *msgQue) SetReconnectPolicy(policy *ReconnectPolicy) {
+	r.reconnect = policy
+}
+
+//关闭消息队列，不会自动重连
+func (r *msgQue) Close() {
+	r.reconnectLock.Lock()
+	atomic.StoreInt32(&r.closing, 1)
+	if r.creconnect != nil {
+		//取消等待中的重连
+		close(r.creconnect)
+		r.creconnect = nil
+	}
+	r.reconnectLock.Unlock()
+	if r.session != nil && r.connTyp == ConnTypeAccept && r.stop == 1 {
+		//会话已断开或由其他连接承载
+		r.session.finalize()
+		return
+	}
+	if msgque := r.getMsgQue(); msgque != nil {
+		msgque.Stop()
+	}
+}
+
+//调用了Close，不再连接
+func (r *msgQue) isClosing() bool {
+	return atomic.LoadInt32(&r.closing) == 1
+}
+
+//重连前等待ms毫秒，等待期间调用Close或程序退出时取消，返回是否继续重连
+func (r *msgQue) waitReconnect(ms int, cstop chan struct{}) bool {
+	if ms > 0 {
+		r.reconnectLock.Lock()
+		if r.isClosing() {
+			r.reconnectLock.Unlock()
+			return false
+		}
+		cancel := make(chan struct{})
+		r.creconnect = cancel
+		r.reconnectLock.Unlock()
+
+		tick := time.NewTimer(time.Millisecond * time.Duration(ms))
+		select {
+		case <-tick.C:
+		case <-cancel:
+		case <-cstop:
+		}
+		tick.Stop()
+
+		r.reconnectLock.Lock()
+		if r.creconnect == cancel {
+			r.creconnect = nil
+		}
+		r.reconnectLock.Unlock()
+	}
+	if r.isClosing() {
+		LogInfo("[msgque] reconnect canceled because closed msgque:%v", r.id)
+		return false
+	}
+	return !IsStop()
+}
+
+//断开后是否会按重连策略重连，在OnDelMsgQue中可用于判断消息队列是否不再使用
+func (r *msgQue) willReconnect() bool {
+	policy := r.reconnect
+	if policy == nil || r.connTyp != ConnTypeConn || atomic.LoadInt32(&r.closing) == 1 || IsStop() {
+		return false
+	}
+	return policy.MaxAttempts <= 0 || r.reconnectAttempts < policy.MaxAttempts
+}
+
+//连接失败或断开后按重连策略重连，在Stop中OnDelMsgQue之后调用
+func (r *msgQue) reconnectByPolicy(msgque IMsgQue) {
+	policy := r.reconnect
+	if policy == nil || r.connTyp != ConnTypeConn || r.closing == 1 || IsStop() {
+		return
+	}
+	if policy.MaxAttempts > 0 && r.reconnectAttempts >= policy.MaxAttempts {
+		LogInfo("[msgque] give up reconnect msgque:%v attempts:%v", r.id, r.reconnectAttempts)
+		if policy.OnGiveUp != nil {
+			policy.OnGiveUp(msgque)
+		}
+		return
+	}
+	delay := policy.delay(r.reconnectAttempts)
+	r.reconnectAttempts++
+	LogInfo("[msgque] reconnect msgque:%v attempts:%v delay:%vms", r.id, r.reconnectAttempts, delay)
+	msgque.reconnectAfter(delay)
+}
+
+//断线期间超过保留数量时返回true
+func (r *msgQue) overPending() bool {
+	if r.reconnect == nil || r.available || r.closing == 1 {
+		return false
+	}
+	limit := r.reconnect.MaxPending
+	if limit <= 0 || limit > cap(r.cwrite) {
+		limit = cap(r.cwrite)
+	}
+	return len(r.cwrite) >= limit
+}
@@ -0,0 +1,73 @@
+package easynet
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	cases := []struct {
+		policy   ReconnectPolicy
+		attempts int
+		want     int
+	}{
+		{ReconnectPolicy{}, 0, defReconnectMinDelay},
+		{ReconnectPolicy{}, 1, defReconnectMinDelay * 2},
+		{ReconnectPolicy{}, 100, defReconnectMaxDelay},
+		{ReconnectPolicy{MinDelay: 100}, 2, 400},
+		{ReconnectPolicy{MinDelay: 100, Factor: 3}, 2, 900},
+		{ReconnectPolicy{MinDelay: 100, MaxDelay: 300}, 5, 300},
+		{ReconnectPolicy{MinDelay: 500, MaxDelay: 100}, 3, 500},
+		{ReconnectPolicy{MaxDelay: 1500}, 4, 1500},
+	}
+	for i, c := range cases {
+		if d := c.policy.delay(c.attempts); d != c.want {
+			t.Fatalf("case:%v attempts:%v delay:%v want:%v", i, c.attempts, d, c.want)
+		}
+	}
+}
+
+//抖动只减少延迟，零值策略不会立即重连
+func TestReconnectDelayJitter(t *testing.T) {
+	p := &ReconnectPolicy{Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := p.delay(0); d < defReconnectMinDelay/2 || d > defReconnectMinDelay {
+			t.Fatalf("delay:%v", d)
+		}
+	}
+}
+
+//等待重连期间调用Close，取消重连，不再连接
+func TestReconnectCloseDuringBackoff(t *testing.T) {
+	s := &testAcceptHandler{accepted: make(chan IMsgQue, 2)}
+	if err := StartServer("tcp://127.0.0.1:29211", MsgTypeMsg, s, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c := StartConnect("tcp", "127.0.0.1:29211", MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+	c.SetReconnectPolicy(&ReconnectPolicy{MinDelay: 200})
+	var sq IMsgQue
+	select {
+	case sq = <-s.accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("accept timeout")
+	}
+	sq.Stop()
+	q := c.(*tcpMsgQue)
+	for i := 0; i < 50 && atomic.LoadInt32(&q.connecting) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&q.connecting) != 1 {
+		t.Fatal("not reconnecting")
+	}
+	c.Close()
+	select {
+	case <-s.accepted:
+		t.Fatal("reconnected after close")
+	case <-time.After(400 * time.Millisecond):
+	}
+	if atomic.LoadInt32(&q.connecting) != 0 || !c.IsStop() {
+		t.Fatal("state", q.connecting, c.IsStop())
+	}
+}
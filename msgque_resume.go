@@ -0,0 +1,474 @@
+/*
+@Time       : 2022/7/28
+@Author     : wuqiusheng
+@File       : msgque_resume.go
+@Description: 会话恢复，用于tcp和ws，连接短暂断开后新连接接管原来的消息队列，补发对方未收到的消息
+			客户端连接后先发送MsgIdResume/ResumeIndexHello(令牌+已接收数量)，服务器回应ResumeIndexWelcome(令牌+已接收数量+是否恢复)
+			双方对带FlagResume的消息计数，发送的消息保存到对方确认(ResumeIndexAck)为止，恢复时补发对方未收到的消息
+			服务器开启会话恢复后，accept的消息队列收到第一个消息后才回调OnNewMsgQue
+			断开后保留消息队列、用户数据和分组，宽限期内未恢复时回调OnDelMsgQue并关闭
+			由新连接承载时原来的消息队列恢复为未停止，Send、Call、SetGroupId和Stop照常使用，Stop断开当前承载的连接
+*/
+package easynet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MsgIdResume uint16 = 0xFFFC //会话恢复消息ID，保留，开启会话恢复时不会交给消息处理器
+)
+
+const (
+	ResumeIndexHello   = 0 //客户端请求，数据为令牌(新会话时为空)+已接收数量
+	ResumeIndexWelcome = 1 //服务器回应，数据为令牌+已接收数量+是否恢复
+	ResumeIndexAck     = 2 //确认已接收数量
+)
+
+const (
+	resumeTokenSize   = 16
+	resumeAckInterval = 32 //每接收多少个消息确认一次
+)
+
+//会话恢复参数
+type ResumeOptions struct {
+	Grace  int //断开后保留会话的时间 s，0表示30s
+	Buffer int //保存的未确认消息数量上限，超过时丢弃最早的消息，0表示1024
+}
+
+type resumeSession struct {
+	token     []byte
+	owner     IMsgQue //会话对应的消息队列，服务器为第一个连接，客户端为自身
+	base      *msgQue
+	transport *msgQue //当前承载会话的连接，nil表示已断开
+	sendSeq   uint32  //已发送的消息数量
+	recvSeq   uint32  //已接收的消息数量
+	buffer    []*Message
+	grace     int
+	limit     int
+	gen       uint32 //断开次数，用于判断宽限期
+	closed    bool
+	lock      sync.Mutex
+	sendLock  sync.Mutex //保证消息按编号顺序写入连接，先于lock获取，发送时不持有lock
+}
+
+var resumeSessions = map[string]*resumeSession{}
+var resumeSessionsSync sync.Mutex
+
+func newResumeSession(base *msgQue, opts *ResumeOptions) *resumeSession {
+	s := &resumeSession{base: base, grace: opts.Grace, limit: opts.Buffer}
+	if s.grace <= 0 {
+		s.grace = 30
+	}
+	if s.limit <= 0 {
+		s.limit = 1024
+	}
+	return s
+}
+
+//发送并保存消息，连接断开时只保存，写入通道满被丢弃时不保存也不计数
+func (r *resumeSession) send(m *Message) bool {
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return false
+	}
+	t := r.transport
+	r.lock.Unlock()
+
+	m.Head.Flags |= FlagResume
+	head := *m.Head
+	rec := &Message{Head: &head, Data: m.Data, buf: m.buf}
+	rec.retain()
+	if t != nil && !t.sendDirect(m) {
+		rec.Release()
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		rec.Release()
+		return true
+	}
+	r.sendSeq++
+	r.buffer = append(r.buffer, rec)
+	if len(r.buffer) > r.limit {
+		r.buffer[0].Release()
+		r.buffer[0] = nil
+		r.buffer = r.buffer[1:]
+	}
+	return true
+}
+
+//丢弃对方已接收的消息
+func (r *resumeSession) trim(peerRecv uint32) {
+	first := r.sendSeq - uint32(len(r.buffer)) + 1
+	n := 0
+	for seq := first; n < len(r.buffer) && seq <= peerRecv; seq++ {
+		r.buffer[n].Release()
+		r.buffer[n] = nil
+		n++
+	}
+	r.buffer = r.buffer[n:]
+}
+
+//对方未收到的消息都还保存着，需要持有锁
+func (r *resumeSession) canReplay(peerRecv uint32) bool {
+	return peerRecv <= r.sendSeq && peerRecv+1 >= r.sendSeq-uint32(len(r.buffer))+1
+}
+
+//复制对方未收到的消息用于补发，有消息已被丢弃时返回false，需要持有锁
+func (r *resumeSession) replay(peerRecv uint32) ([]*Message, bool) {
+	if !r.canReplay(peerRecv) {
+		return nil, false
+	}
+	r.trim(peerRecv)
+	list := make([]*Message, 0, len(r.buffer))
+	for _, rec := range r.buffer {
+		head := *rec.Head
+		m := &Message{Head: &head, Data: rec.Data, buf: rec.buf}
+		m.retain()
+		list = append(list, m)
+	}
+	return list, true
+}
+
+func (r *resumeSession) ack(peerRecv uint32) {
+	r.lock.Lock()
+	if peerRecv <= r.sendSeq {
+		r.trim(peerRecv)
+	}
+	r.lock.Unlock()
+}
+
+func (r *resumeSession) onRecv() {
+	r.lock.Lock()
+	r.recvSeq++
+	seq, t := r.recvSeq, r.transport
+	r.lock.Unlock()
+	if seq%resumeAckInterval == 0 && t != nil {
+		t.pushWrite(NewMsg(MsgIdResume, ResumeIndexAck, resumeSeqBytes(nil, seq)))
+	}
+}
+
+func (r *resumeSession) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+func (r *resumeSession) getTransport() *msgQue {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.transport
+}
+
+//连接断开，服务器在宽限期后关闭会话
+func (r *resumeSession) detach(t *msgQue) {
+	r.lock.Lock()
+	if r.closed || r.transport != t {
+		r.lock.Unlock()
+		return
+	}
+	r.transport = nil
+	r.gen++
+	gen := r.gen
+	r.base.available = false
+	if r.base.connTyp == ConnTypeAccept {
+		//断开期间原来的消息队列视为已停止
+		atomic.StoreInt32(&r.base.stop, 1)
+	}
+	r.lock.Unlock()
+	if r.base.connTyp != ConnTypeAccept {
+		return
+	}
+	LogInfo("[msgque]session detach msgque:%v grace:%vs", r.base.id, r.grace)
+	SetTimeout(r.grace*1000, func(...interface{}) int {
+		r.lock.Lock()
+		expired := !r.closed && r.transport == nil && r.gen == gen
+		r.lock.Unlock()
+		if expired {
+			LogInfo("[msgque]session expired msgque:%v", r.base.id)
+			r.finalize()
+		}
+		return 0
+	})
+}
+
+//标记会话关闭并释放保存的消息，返回关闭前承载会话的连接，已经关闭时返回false
+func (r *resumeSession) close() (*msgQue, bool) {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil, false
+	}
+	r.closed = true
+	t := r.transport
+	r.transport = nil
+	for _, m := range r.buffer {
+		m.Release()
+	}
+	r.buffer = nil
+	r.lock.Unlock()
+	if r.token != nil {
+		resumeSessionsSync.Lock()
+		if resumeSessions[string(r.token)] == r {
+			delete(resumeSessions, string(r.token))
+		}
+		resumeSessionsSync.Unlock()
+	}
+	return t, true
+}
+
+//关闭已断开或由其他连接承载的服务器会话
+func (r *resumeSession) finalize() {
+	t, ok := r.close()
+	if !ok {
+		return
+	}
+	if t != nil && t != r.base {
+		if msgque := t.getMsgQue(); msgque != nil {
+			msgque.Stop()
+		}
+	}
+	if atomic.LoadInt32(&r.base.stop) == 0 {
+		//未断开，按正常流程关闭
+		r.owner.Stop()
+		return
+	}
+	r.base.handler.OnDelMsgQue(r.owner)
+	r.base.available = false
+	r.base.baseStop()
+}
+
+func resumeSeqBytes(data []byte, seq uint32) []byte {
+	buf := make([]byte, 4)
+	msgHeadByteOrder.PutUint32(buf, seq)
+	return append(data, buf...)
+}
+
+func newResumeToken() []byte {
+	token := make([]byte, resumeTokenSize)
+	rand.Read(token)
+	return token
+}
+
+//会话恢复消息，hello只在服务器等待第一个消息时处理，welcome只在客户端处理
+func (r *msgQue) onResume(msgque IMsgQue, msg *Message) bool {
+	data := msg.Data
+	switch msg.Head.Index {
+	case ResumeIndexHello:
+		if !r.resumeWait {
+			return true
+		}
+		r.resumeWait = false
+		if len(data) != 4 && len(data) != resumeTokenSize+4 {
+			LogError("[msgque]resume hello len err msgque:%v len:%v", r.id, len(data))
+			return false
+		}
+		token := data[:len(data)-4]
+		peerRecv := msgHeadByteOrder.Uint32(data[len(data)-4:])
+		if len(token) > 0 && r.resumeAttach(token, peerRecv) {
+			return true
+		}
+		return r.resumeNew(msgque)
+	case ResumeIndexWelcome:
+		s := r.session
+		if s == nil || r.connTyp != ConnTypeConn || len(data) != resumeTokenSize+5 {
+			return true
+		}
+		peerRecv := msgHeadByteOrder.Uint32(data[resumeTokenSize:])
+		resumed := data[resumeTokenSize+4] == 1
+		s.sendLock.Lock()
+		s.lock.Lock()
+		s.token = append([]byte(nil), data[:resumeTokenSize]...)
+		if !resumed {
+			//新会话，未确认的消息重新编号后全部发送
+			s.sendSeq = uint32(len(s.buffer))
+			s.recvSeq = 0
+			peerRecv = 0
+		}
+		list, ok := s.replay(peerRecv)
+		if !ok {
+			LogError("[msgque]resume lost msg msgque:%v peer recv:%v send:%v", r.id, peerRecv, s.sendSeq)
+			s.trim(s.sendSeq)
+		}
+		s.transport = r
+		s.lock.Unlock()
+		r.sendReplay(list)
+		s.sendLock.Unlock()
+		LogInfo("[msgque]session welcome msgque:%v resumed:%v", r.id, resumed)
+	case ResumeIndexAck:
+		if len(data) < 4 {
+			return true
+		}
+		if s := r.resumeSession(); s != nil {
+			s.ack(msgHeadByteOrder.Uint32(data))
+		}
+	}
+	return true
+}
+
+//新会话，回调OnNewMsgQue后回应令牌
+func (r *msgQue) resumeNew(msgque IMsgQue) bool {
+	s := newResumeSession(r, r.resumeOpts)
+	s.owner = msgque
+	s.token = newResumeToken()
+	r.session = s
+	if !r.handler.OnNewMsgQue(msgque) {
+		r.session = nil
+		s.close()
+		return false
+	}
+	r.init = true
+	resumeSessionsSync.Lock()
+	resumeSessions[string(s.token)] = s
+	resumeSessionsSync.Unlock()
+
+	s.sendLock.Lock()
+	s.lock.Lock()
+	welcome := NewMsg(MsgIdResume, ResumeIndexWelcome, append(resumeSeqBytes(append([]byte(nil), s.token...), 0), 0))
+	list, _ := s.replay(0)
+	s.transport = r
+	s.lock.Unlock()
+	r.pushWrite(welcome)
+	r.sendReplay(list)
+	s.sendLock.Unlock()
+	LogInfo("[msgque]session new msgque:%v", r.id)
+	return true
+}
+
+//新连接接管原来的会话，失败时关闭原来的会话
+func (r *msgQue) resumeAttach(token []byte, peerRecv uint32) bool {
+	resumeSessionsSync.Lock()
+	s := resumeSessions[string(token)]
+	resumeSessionsSync.Unlock()
+	if s == nil || !bytes.Equal(s.token, token) {
+		return false
+	}
+	s.sendLock.Lock()
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		s.sendLock.Unlock()
+		return false
+	}
+	if !s.canReplay(peerRecv) {
+		s.lock.Unlock()
+		s.sendLock.Unlock()
+		LogWarn("[msgque]resume failed msg lost msgque:%v peer recv:%v send:%v", s.base.id, peerRecv, s.sendSeq)
+		s.finalize()
+		return false
+	}
+	old := s.transport
+	s.gen++
+	welcome := NewMsg(MsgIdResume, ResumeIndexWelcome, append(resumeSeqBytes(append([]byte(nil), s.token...), s.recvSeq), 1))
+	list, _ := s.replay(peerRecv)
+	s.transport = r
+	r.setResumed(s)
+	s.base.available = true
+	atomic.StoreInt32(&s.base.stop, 0)
+	s.lock.Unlock()
+	r.pushWrite(welcome)
+	r.sendReplay(list)
+	s.sendLock.Unlock()
+
+	//旧连接可能还未发现断开
+	if old != nil && old != r {
+		if msgque := old.getMsgQue(); msgque != nil {
+			msgque.Stop()
+		}
+	}
+	LogInfo("[msgque]session resume msgque:%v by msgque:%v", s.base.id, r.id)
+	return true
+}
+
+//补发会话中对方未收到的消息，需要持有会话的sendLock
+func (r *msgQue) sendReplay(list []*Message) {
+	for _, m := range list {
+		r.sendDirect(m)
+	}
+}
+
+func (r *msgQue) setResumed(s *resumeSession) {
+	r.callbackLock.Lock()
+	r.resumed = s
+	r.callbackLock.Unlock()
+}
+
+func (r *msgQue) getResumed() *resumeSession {
+	r.callbackLock.Lock()
+	defer r.callbackLock.Unlock()
+	return r.resumed
+}
+
+//承载或拥有的会话，承载的会话关闭后返回nil
+func (r *msgQue) resumeSession() *resumeSession {
+	if s := r.getResumed(); s != nil {
+		if s.isClosed() {
+			return nil
+		}
+		return s
+	}
+	return r.session
+}
+
+//连接断开时调用，返回true表示保留会话，不回调OnDelMsgQue也不清理
+func (r *msgQue) resumeDetach() bool {
+	if s := r.getResumed(); s != nil {
+		s.detach(r)
+		return false
+	}
+	s := r.session
+	if s == nil || s.isClosed() {
+		return false
+	}
+	if r.connTyp == ConnTypeConn {
+		if atomic.LoadInt32(&r.closing) == 1 {
+			s.close()
+		} else {
+			s.detach(r)
+		}
+		return false
+	}
+	if atomic.LoadInt32(&r.closing) == 1 || IsStop() {
+		if t, _ := s.close(); t != nil && t != r {
+			if msgque := t.getMsgQue(); msgque != nil {
+				msgque.Stop()
+			}
+		}
+		return false
+	}
+	if t := s.getTransport(); t != nil && t != r {
+		//由其他连接承载时断开该连接，会话在宽限期内仍可恢复
+		if msgque := t.getMsgQue(); msgque != nil {
+			msgque.Stop()
+		}
+		return true
+	}
+	s.detach(r)
+	return true
+}
+
+//客户端连接成功后丢弃写入通道中的旧消息并请求恢复，会话中的消息在收到回应后补发
+func (r *msgQue) resumeConnect() {
+	s := r.session
+	if s == nil {
+		return
+	}
+	for len(r.cwrite) > 0 {
+		if m := <-r.cwrite; m != nil {
+			m.Release()
+		}
+	}
+	s.lock.Lock()
+	data := resumeSeqBytes(append([]byte(nil), s.token...), s.recvSeq)
+	s.lock.Unlock()
+	r.pushWrite(NewMsg(MsgIdResume, ResumeIndexHello, data))
+}
@@ -0,0 +1,129 @@
+package easynet
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testResumeServer struct {
+	DefMsgHandler
+	owner          chan IMsgQue
+	newCnt, delCnt int32
+}
+
+func (r *testResumeServer) OnNewMsgQue(msgque IMsgQue) bool {
+	atomic.AddInt32(&r.newCnt, 1)
+	r.owner <- msgque
+	return true
+}
+
+func (r *testResumeServer) OnDelMsgQue(msgque IMsgQue) {
+	atomic.AddInt32(&r.delCnt, 1)
+}
+
+//回应服务器的请求
+type testResumeClient struct {
+	DefMsgHandler
+}
+
+func (r *testResumeClient) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	msgque.Send(NewMsg(msg.Id(), 0, append([]byte(nil), msg.Data...)).CopyTag(msg))
+	return true
+}
+
+//新连接接管会话后原来的消息队列可以继续使用，Stop只断开承载的连接
+func TestResumeOwnerAfterAttach(t *testing.T) {
+	sh := &testResumeServer{owner: make(chan IMsgQue, 1)}
+	if err := StartServerWithOptions("tcp://127.0.0.1:29161", MsgTypeMsg, sh, nil, &MsgQueOptions{Resume: &ResumeOptions{Grace: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c := StartConnectWithOptions("tcp", "127.0.0.1:29161", MsgTypeMsg, &testResumeClient{}, nil, nil,
+		&MsgQueOptions{Resume: &ResumeOptions{}, Reconnect: &ReconnectPolicy{MinDelay: 50, MaxDelay: 50}})
+	var owner IMsgQue
+	select {
+	case owner = <-sh.owner:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no session")
+	}
+	call := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		m, err := owner.Call(ctx, NewMsg(5, 0, []byte("ping")))
+		if err != nil || string(m.Data) != "ping" {
+			t.Fatal("call", err)
+		}
+	}
+	waitResumed := func() {
+		for i := 0; i < 100 && (owner.IsStop() || !owner.Available()); i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if owner.IsStop() || !owner.Available() {
+			t.Fatal("not resumed")
+		}
+	}
+	call()
+
+	//断开客户端的连接，重连后由新连接承载
+	c.(*tcpMsgQue).conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	waitResumed()
+	call()
+	owner.SetGroupId("resume-owner")
+	if GroupCount("resume-owner") != 1 {
+		t.Fatal("group")
+	}
+
+	//Stop断开承载的连接，会话再次恢复
+	owner.Stop()
+	time.Sleep(100 * time.Millisecond)
+	waitResumed()
+	call()
+	if atomic.LoadInt32(&sh.newCnt) != 1 || atomic.LoadInt32(&sh.delCnt) != 0 {
+		t.Fatal("cnt", sh.newCnt, sh.delCnt)
+	}
+
+	//客户端关闭后宽限期结束时关闭会话
+	c.Close()
+	for i := 0; i < 100 && atomic.LoadInt32(&sh.delCnt) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&sh.delCnt) != 1 || !owner.IsStop() || GroupCount("resume-owner") != 0 {
+		t.Fatal("not closed", sh.delCnt, owner.IsStop())
+	}
+}
+
+//写入通道满被丢弃的消息不计数也不保存，阻塞发送时不持有会话锁
+func TestResumeSendDropped(t *testing.T) {
+	q := testFullMsgQue(&DefMsgHandler{}, SendPolicyDropNew, 0)
+	defer q.Stop()
+	s := newResumeSession(&q.msgQue, &ResumeOptions{})
+	s.transport = &q.msgQue
+	if s.send(NewMsg(3, 0, nil)) || s.sendSeq != 0 || len(s.buffer) != 0 {
+		t.Fatal("dropped msg kept", s.sendSeq, len(s.buffer))
+	}
+
+	q.SetSendPolicy(SendPolicyBlock, 200)
+	done := make(chan bool, 1)
+	go func() {
+		done <- s.send(NewMsg(4, 0, nil))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	s.ack(0)
+	s.onRecv()
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("session locked while sending", time.Since(start))
+	}
+	if <-done || s.sendSeq != 0 || len(s.buffer) != 0 {
+		t.Fatal("timeout msg kept", s.sendSeq, len(s.buffer))
+	}
+
+	<-q.cwrite
+	<-q.cwrite
+	if !s.send(NewMsg(5, 0, nil)) || s.sendSeq != 1 || len(s.buffer) != 1 {
+		t.Fatal("sent msg not kept", s.sendSeq, len(s.buffer))
+	}
+}
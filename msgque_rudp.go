@@ -0,0 +1,428 @@
+/*
+@Time       : 2022/6/24
+@Author     : wuqiusheng
+@File       : msgque_rudp.go
+@Description: 可靠udp，参考kcp实现的arq
+			数据报格式 MessageHead + 段头 + 消息(MessageHead+Data)，段头字节序与消息头一致
+			数据段 Flags:FlagNeedAck(重发时附加FlagReSend) 段头:sn(4) una(4) wnd(2) ts(4) frg(2)
+			消息按RudpMtu分段，frg为之后剩余的分段数，0表示消息的最后一段，避免大数据报在ip层分片
+			确认段 Flags:FlagAck 段头:una(4) wnd(2) 之后为选择确认列表 sn(4) ts(4)
+			支持选择确认，快速重传，rto估算，发送窗口与拥塞控制
+*/
+package easynet
+
+import (
+	"sync"
+)
+
+const (
+	rudpDataHeadSize = 16 //数据段头长度
+	rudpAckHeadSize  = 6  //确认段头长度
+	rudpAckItemSize  = 8  //选择确认项长度
+
+	rudpRtoMin     = 30    //最小rto ms
+	rudpRtoDef     = 200   //默认rto ms
+	rudpRtoMax     = 60000 //最大rto ms
+	rudpFastResend = 2     //被跳过多少次确认后快速重传
+	rudpDeadLink   = 20    //重传多少次后认为连接断开
+	rudpThreshInit = 2     //初始慢启动阈值
+	rudpThreshMin  = 2     //最小慢启动阈值
+)
+
+//最大消息长度，超过的消息无法通过可靠udp发送
+var RudpMaxMsgSize = MaxUdpPacketSize - MsgHeadSize
+
+type rudpAck struct {
+	sn uint32
+	ts uint32
+}
+
+type rudpSegment struct {
+	sn       uint32
+	ts       uint32
+	resendTs uint32
+	rto      uint32
+	fastack  uint32
+	xmit     uint32
+	frg      uint16
+	data     []byte
+}
+
+type rudpFragment struct {
+	frg  uint16
+	data []byte
+}
+
+type rudpArq struct {
+	lock       sync.Mutex
+	outputFunc func(data []byte) error
+
+	sndUna uint32 //最早未确认的序号
+	sndNxt uint32 //下一个发送序号
+	rcvNxt uint32 //下一个待接收序号
+
+	sndWnd   uint32
+	rcvWnd   uint32
+	rmtWnd   uint32 //远端接收窗口
+	cwnd     uint32 //拥塞窗口
+	incr     uint32 //拥塞避免阶段的增量，单位为字节
+	ssthresh uint32 //慢启动阈值
+	mss      uint32
+
+	srtt   int32
+	rttvar int32
+	rto    uint32
+
+	sndQueue []*rudpSegment          //等待进入发送窗口的分段
+	sndBuf   []*rudpSegment          //已发送未确认，按sn排序
+	rcvBuf   map[uint32]rudpFragment //乱序到达等待交付
+	rcvPart  []byte                  //按序到达但未收齐的消息
+	ackList  []rudpAck
+	dead     bool
+}
+
+func rudpNow() uint32 {
+	return uint32(NowMs - StartMs)
+}
+
+//序号比较，处理回绕
+func rudpDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+func (r *rudpArq) waitSnd() int {
+	r.lock.Lock()
+	n := len(r.sndBuf) + len(r.sndQueue)
+	r.lock.Unlock()
+	return n
+}
+
+//等待发送的分段达到该值时写入协程暂停读取写入通道，由发送策略处理积压
+func (r *rudpArq) sndQueueLimit() int {
+	return int(r.sndWnd) * 2
+}
+
+//发送一条完整的消息，按mss分段，分段在窗口允许时才会真正发出
+func (r *rudpArq) send(data []byte) bool {
+	if len(data) > RudpMaxMsgSize {
+		return false
+	}
+	count := (len(data) + int(r.mss) - 1) / int(r.mss)
+	if count == 0 {
+		count = 1
+	}
+	r.lock.Lock()
+	for i := 0; i < count; i++ {
+		end := (i + 1) * int(r.mss)
+		if end > len(data) {
+			end = len(data)
+		}
+		r.sndQueue = append(r.sndQueue, &rudpSegment{frg: uint16(count - 1 - i), data: data[i*int(r.mss) : end]})
+	}
+	r.lock.Unlock()
+	return true
+}
+
+func (r *rudpArq) updateRtt(rtt int32) {
+	if r.srtt == 0 {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+	} else {
+		delta := rtt - r.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		r.rttvar = (3*r.rttvar + delta) / 4
+		r.srtt = (7*r.srtt + rtt) / 8
+		if r.srtt < 1 {
+			r.srtt = 1
+		}
+	}
+	rto := uint32(r.srtt + 4*r.rttvar)
+	if rto < rudpRtoMin {
+		rto = rudpRtoMin
+	} else if rto > rudpRtoMax {
+		rto = rudpRtoMax
+	}
+	r.rto = rto
+}
+
+func (r *rudpArq) shrinkBuf() {
+	if len(r.sndBuf) > 0 {
+		r.sndUna = r.sndBuf[0].sn
+	} else {
+		r.sndUna = r.sndNxt
+	}
+}
+
+func (r *rudpArq) parseUna(una uint32) {
+	i := 0
+	for ; i < len(r.sndBuf); i++ {
+		if rudpDiff(una, r.sndBuf[i].sn) <= 0 {
+			break
+		}
+	}
+	if i > 0 {
+		r.sndBuf = r.sndBuf[i:]
+	}
+}
+
+func (r *rudpArq) parseAck(sn uint32) {
+	if rudpDiff(sn, r.sndUna) < 0 || rudpDiff(sn, r.sndNxt) >= 0 {
+		return
+	}
+	for i, seg := range r.sndBuf {
+		if seg.sn == sn {
+			r.sndBuf = append(r.sndBuf[:i], r.sndBuf[i+1:]...)
+			break
+		}
+		if rudpDiff(sn, seg.sn) < 0 {
+			break
+		}
+		seg.fastack++
+	}
+}
+
+//处理收到的数据报，返回按序交付的消息，返回false表示数据报非法
+func (r *rudpArq) input(packet []byte) ([][]byte, bool) {
+	head := NewMessageHead(packet)
+	if head == nil || int(head.Len) != len(packet)-MsgHeadSize {
+		return nil, false
+	}
+	body := packet[MsgHeadSize:]
+	now := rudpNow()
+	var out [][]byte
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	oldUna := r.sndUna
+	if head.Flags&FlagAck > 0 {
+		if len(body) < rudpAckHeadSize || (len(body)-rudpAckHeadSize)%rudpAckItemSize != 0 {
+			return nil, false
+		}
+		r.parseUna(msgHeadByteOrder.Uint32(body))
+		r.rmtWnd = uint32(msgHeadByteOrder.Uint16(body[4:]))
+		r.shrinkBuf()
+		for i := rudpAckHeadSize; i < len(body); i += rudpAckItemSize {
+			sn := msgHeadByteOrder.Uint32(body[i:])
+			ts := msgHeadByteOrder.Uint32(body[i+4:])
+			if rtt := rudpDiff(now, ts); rtt >= 0 {
+				r.updateRtt(rtt)
+			}
+			r.parseAck(sn)
+			r.shrinkBuf()
+		}
+	} else if head.Flags&FlagNeedAck > 0 {
+		if len(body) < rudpDataHeadSize {
+			return nil, false
+		}
+		sn := msgHeadByteOrder.Uint32(body)
+		r.parseUna(msgHeadByteOrder.Uint32(body[4:]))
+		r.rmtWnd = uint32(msgHeadByteOrder.Uint16(body[8:]))
+		ts := msgHeadByteOrder.Uint32(body[10:])
+		frg := msgHeadByteOrder.Uint16(body[14:])
+		r.shrinkBuf()
+		if rudpDiff(sn, r.rcvNxt+r.rcvWnd) < 0 {
+			r.ackList = append(r.ackList, rudpAck{sn: sn, ts: ts})
+			if rudpDiff(sn, r.rcvNxt) >= 0 {
+				if _, ok := r.rcvBuf[sn]; !ok {
+					r.rcvBuf[sn] = rudpFragment{frg: frg, data: body[rudpDataHeadSize:]}
+				}
+			}
+		}
+		for {
+			f, ok := r.rcvBuf[r.rcvNxt]
+			if !ok {
+				break
+			}
+			delete(r.rcvBuf, r.rcvNxt)
+			r.rcvNxt++
+			if f.frg == 0 && r.rcvPart == nil {
+				out = append(out, f.data)
+				continue
+			}
+			if len(r.rcvPart)+len(f.data) > RudpMaxMsgSize {
+				return nil, false
+			}
+			r.rcvPart = append(r.rcvPart, f.data...)
+			if f.frg == 0 {
+				out = append(out, r.rcvPart)
+				r.rcvPart = nil
+			}
+		}
+	} else {
+		return nil, false
+	}
+
+	//收到新的确认，扩大拥塞窗口
+	if rudpDiff(r.sndUna, oldUna) > 0 && r.cwnd < r.rmtWnd {
+		if r.cwnd < r.ssthresh {
+			r.cwnd++
+			r.incr += r.mss
+		} else {
+			if r.incr < r.mss {
+				r.incr = r.mss
+			}
+			r.incr += (r.mss*r.mss)/r.incr + r.mss/16
+			if (r.cwnd+1)*r.mss <= r.incr {
+				r.cwnd++
+			}
+		}
+		if r.cwnd > r.rmtWnd {
+			r.cwnd = r.rmtWnd
+			r.incr = r.rmtWnd * r.mss
+		}
+	}
+	return out, true
+}
+
+func (r *rudpArq) wndUnused() uint16 {
+	if n := len(r.rcvBuf); uint32(n) < r.rcvWnd {
+		return uint16(r.rcvWnd - uint32(n))
+	}
+	return 0
+}
+
+func (r *rudpArq) flushAck() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.flushAckLocked()
+}
+
+func (r *rudpArq) flushAckLocked() {
+	for len(r.ackList) > 0 {
+		n := len(r.ackList)
+		if max := int(r.mss-rudpAckHeadSize) / rudpAckItemSize; n > max {
+			n = max
+		}
+		body := make([]byte, MsgHeadSize+rudpAckHeadSize+n*rudpAckItemSize)
+		msgHeadByteOrder.PutUint32(body[MsgHeadSize:], r.rcvNxt)
+		msgHeadByteOrder.PutUint16(body[MsgHeadSize+4:], r.wndUnused())
+		for i, ack := range r.ackList[:n] {
+			pos := MsgHeadSize + rudpAckHeadSize + i*rudpAckItemSize
+			msgHeadByteOrder.PutUint32(body[pos:], ack.sn)
+			msgHeadByteOrder.PutUint32(body[pos+4:], ack.ts)
+		}
+		head := &MessageHead{Len: uint32(len(body) - MsgHeadSize), Flags: FlagAck}
+		head.FastBytes(body)
+		r.output(body)
+		r.ackList = r.ackList[n:]
+	}
+	r.ackList = nil
+}
+
+func (r *rudpArq) output(data []byte) {
+	if r.outputFunc != nil {
+		r.outputFunc(data)
+	}
+}
+
+func (r *rudpArq) outputSeg(seg *rudpSegment, flags uint8) {
+	packet := make([]byte, MsgHeadSize+rudpDataHeadSize+len(seg.data))
+	head := &MessageHead{Len: uint32(len(packet) - MsgHeadSize), Flags: flags}
+	head.FastBytes(packet)
+	body := packet[MsgHeadSize:]
+	msgHeadByteOrder.PutUint32(body, seg.sn)
+	msgHeadByteOrder.PutUint32(body[4:], r.rcvNxt)
+	msgHeadByteOrder.PutUint16(body[8:], r.wndUnused())
+	msgHeadByteOrder.PutUint32(body[10:], seg.ts)
+	msgHeadByteOrder.PutUint16(body[14:], seg.frg)
+	copy(body[rudpDataHeadSize:], seg.data)
+	r.output(packet)
+}
+
+//发送确认，将窗口内的消息发出，处理超时重传与快速重传，返回false表示连接已断开
+func (r *rudpArq) flush() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.dead {
+		return false
+	}
+	r.flushAckLocked()
+
+	cwnd := r.sndWnd
+	if r.rmtWnd < cwnd {
+		cwnd = r.rmtWnd
+	}
+	if !Config.RudpNoCwnd && r.cwnd < cwnd {
+		cwnd = r.cwnd
+	}
+	if cwnd == 0 { //远端窗口为0时依然允许发送一条用于探测
+		cwnd = 1
+	}
+	for len(r.sndQueue) > 0 && rudpDiff(r.sndNxt, r.sndUna+cwnd) < 0 {
+		seg := r.sndQueue[0]
+		seg.sn = r.sndNxt
+		r.sndBuf = append(r.sndBuf, seg)
+		r.sndQueue[0] = nil
+		r.sndQueue = r.sndQueue[1:]
+		r.sndNxt++
+	}
+
+	now := rudpNow()
+	lost := false
+	change := false
+	for _, seg := range r.sndBuf {
+		var flags uint8 = FlagNeedAck
+		if seg.xmit == 0 {
+			seg.rto = r.rto
+			seg.resendTs = now + seg.rto
+		} else if rudpDiff(now, seg.resendTs) >= 0 {
+			seg.rto += seg.rto / 2
+			if seg.rto > rudpRtoMax {
+				seg.rto = rudpRtoMax
+			}
+			seg.resendTs = now + seg.rto
+			flags |= FlagReSend
+			lost = true
+		} else if seg.fastack >= rudpFastResend {
+			seg.fastack = 0
+			seg.resendTs = now + seg.rto
+			flags |= FlagReSend
+			change = true
+		} else {
+			continue
+		}
+		seg.xmit++
+		seg.ts = now
+		r.outputSeg(seg, flags)
+		if seg.xmit >= rudpDeadLink {
+			r.dead = true
+		}
+	}
+
+	if change {
+		inflight := r.sndNxt - r.sndUna
+		r.ssthresh = inflight / 2
+		if r.ssthresh < rudpThreshMin {
+			r.ssthresh = rudpThreshMin
+		}
+		r.cwnd = r.ssthresh + rudpFastResend
+		r.incr = r.cwnd * r.mss
+	}
+	if lost {
+		r.ssthresh = r.cwnd / 2
+		if r.ssthresh < rudpThreshMin {
+			r.ssthresh = rudpThreshMin
+		}
+		r.cwnd = 1
+		r.incr = r.mss
+	}
+	return !r.dead
+}
+
+func newRudpArq(output func(data []byte) error) *rudpArq {
+	arq := &rudpArq{
+		outputFunc: output,
+		sndWnd:     uint32(Config.RudpSndWnd),
+		rcvWnd:     uint32(Config.RudpRcvWnd),
+		rmtWnd:     uint32(Config.RudpRcvWnd),
+		cwnd:       1,
+		ssthresh:   rudpThreshInit,
+		mss:        uint32(Config.RudpMtu - MsgHeadSize - rudpDataHeadSize),
+		rto:        rudpRtoDef,
+		rcvBuf:     map[uint32]rudpFragment{},
+	}
+	arq.incr = arq.mss
+	return arq
+}
@@ -0,0 +1,70 @@
+package easynet
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+//双向丢包30%，乱序到达，大消息按mtu分段
+func TestRudpArqLossy(t *testing.T) {
+	Config.RudpNoCwnd = true
+	defer func() { Config.RudpNoCwnd = false }()
+	var a, b *rudpArq
+	var lock sync.Mutex
+	var got [][]byte
+	lossy := func(dst **rudpArq, deliver bool) func([]byte) error {
+		return func(d []byte) error {
+			if len(d) > Config.RudpMtu {
+				t.Errorf("packet len:%v over mtu", len(d))
+			}
+			if rand.Intn(100) < 30 {
+				return nil
+			}
+			cp := append([]byte(nil), d...)
+			go func() {
+				time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+				msgs, ok := (*dst).input(cp)
+				if !ok {
+					t.Errorf("bad input")
+				}
+				(*dst).flushAck()
+				if deliver {
+					lock.Lock()
+					got = append(got, msgs...)
+					lock.Unlock()
+				}
+			}()
+			return nil
+		}
+	}
+	a = newRudpArq(lossy(&b, true))
+	b = newRudpArq(lossy(&a, false))
+	const count = 300
+	for i := 0; i < count; i++ {
+		a.send(bytes.Repeat([]byte{byte(i)}, 1+i*17))
+	}
+	for i := 0; i < 5000; i++ {
+		a.flush()
+		b.flush()
+		time.Sleep(2 * time.Millisecond)
+		lock.Lock()
+		n := len(got)
+		lock.Unlock()
+		if n == count {
+			break
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(got) != count {
+		t.Fatalf("got %d", len(got))
+	}
+	for i, d := range got {
+		if !bytes.Equal(d, bytes.Repeat([]byte{byte(i)}, 1+i*17)) {
+			t.Fatalf("msg %d mismatch len:%v", i, len(d))
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+@Time       : 2022/7/6
+@Author     : wuqiusheng
+@File       : msgque_send.go
+@Description: 写入通道满时的处理策略，避免一个慢连接阻塞发送者
+			SendPolicyBlock   阻塞等待，设置超时后超时丢弃，默认且不超时，与旧版本一致
+			SendPolicyDropNew 丢弃当前发送的消息
+			SendPolicyDropOld 丢弃写入通道中最早的消息
+			SendPolicyClose   关闭消息队列
+			丢弃超长消息的分片会导致对端丢弃整条消息，需要发送超长消息时建议使用SendPolicyBlock或SendPolicyClose
+*/
+package easynet
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type SendPolicy int
+
+const (
+	SendPolicyBlock SendPolicy = iota
+	SendPolicyDropNew
+	SendPolicyDropOld
+	SendPolicyClose
+)
+
+func (r *msgQue) SetSendPolicy(policy SendPolicy, timeout int) {
+	r.sendPolicy = policy
+	if timeout >= 0 {
+		r.sendTimeout = timeout
+	}
+}
+
+func (r *msgQue) SetHighWater(n int) {
+	if n >= 0 {
+		r.highWater = n
+	}
+}
+
+func (r *msgQue) DroppedCount() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+func (r *msgQue) Pending() int {
+	r.callbackLock.Lock()
+	calls := len(r.calls)
+	r.callbackLock.Unlock()
+	return len(r.cwrite) + calls
+}
+
+//放入写入通道，返回false表示消息被丢弃，写入通道持有消息的引用，写入协程写入后释放
+func (r *msgQue) pushWrite(m *Message) (re bool) {
+	m.retain()
+	defer func() {
+		if err := recover(); err != nil {
+			//写入通道已关闭，释放写入通道的引用
+			m.Release()
+			re = false
+		}
+	}()
+	if r.overPending() {
+		r.drop(m)
+		return false
+	}
+	select {
+	case r.cwrite <- m:
+		r.checkHighWater()
+		return true
+	default:
+	}
+
+	switch r.sendPolicy {
+	case SendPolicyDropNew:
+		r.drop(m)
+		return false
+	case SendPolicyDropOld:
+		for {
+			select {
+			case r.cwrite <- m:
+				r.checkHighWater()
+				return true
+			default:
+			}
+			select {
+			case old := <-r.cwrite:
+				if old != nil {
+					r.drop(old)
+				}
+			default:
+			}
+		}
+	case SendPolicyClose:
+		r.drop(m)
+		LogWarn("[msgque]close because write channel full msgque:%v", r.id)
+		if msgque := r.getMsgQue(); msgque != nil {
+			msgque.Stop()
+		}
+		return false
+	}
+
+	LogWarn("[msgque]obstruct,write channel full msgque:%v", r.id)
+	if r.sendTimeout <= 0 {
+		r.cwrite <- m
+		r.checkHighWater()
+		return true
+	}
+	tick := time.NewTimer(time.Millisecond * time.Duration(r.sendTimeout))
+	defer tick.Stop()
+	select {
+	case r.cwrite <- m:
+		r.checkHighWater()
+		return true
+	case <-tick.C:
+		r.drop(m)
+		return false
+	}
+}
+
+func (r *msgQue) drop(m *Message) {
+	m.Release()
+	cnt := atomic.AddUint64(&r.dropped, 1)
+	LogDebug("[msgque]drop msg because write channel full msgque:%v id:%v dropped:%v", r.id, m.Id(), cnt)
+}
+
+//积压达到高水位时回调一次，降到一半以下后可再次触发，消息处理器实现ISendHighWaterHandler时才回调
+func (r *msgQue) checkHighWater() {
+	if r.highWater <= 0 {
+		return
+	}
+	handler, ok := r.handler.(ISendHighWaterHandler)
+	if !ok {
+		return
+	}
+	pending := len(r.cwrite)
+	if pending >= r.highWater {
+		if atomic.CompareAndSwapInt32(&r.highWaterHit, 0, 1) {
+			if msgque := r.getMsgQue(); msgque != nil {
+				handler.OnSendHighWater(msgque, pending)
+			}
+		}
+	} else if pending < r.highWater/2 && r.highWaterHit == 1 {
+		atomic.StoreInt32(&r.highWaterHit, 0)
+	}
+}
@@ -0,0 +1,121 @@
+package easynet
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//记录高水位回调
+type testHighWaterHandler struct {
+	DefMsgHandler
+	hits int32
+}
+
+func (r *testHighWaterHandler) OnSendHighWater(msgque IMsgQue, pending int) {
+	atomic.AddInt32(&r.hits, 1)
+}
+
+//写入通道已满的消息队列，未连接，不会被写入协程读取
+func testFullMsgQue(handler IMsgHandler, policy SendPolicy, timeout int) *tcpMsgQue {
+	q := newTcpConn("tcp", "127.0.0.1:1", nil, MsgTypeMsg, handler, nil, nil)
+	q.cwrite = make(chan *Message, 2)
+	q.SetSendPolicy(policy, timeout)
+	q.pushWrite(NewMsg(1, 0, nil))
+	q.pushWrite(NewMsg(2, 0, nil))
+	return q
+}
+
+func TestSendPolicyBlockTimeout(t *testing.T) {
+	q := testFullMsgQue(&DefMsgHandler{}, SendPolicyBlock, 50)
+	defer q.Stop()
+	start := time.Now()
+	if q.Send(NewMsg(3, 0, nil)) {
+		t.Fatal("sent to full channel")
+	}
+	if time.Since(start) < 50*time.Millisecond || q.DroppedCount() != 1 {
+		t.Fatal("block timeout", time.Since(start), q.DroppedCount())
+	}
+
+	//超时前写入通道有空位时发送成功
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-q.cwrite
+	}()
+	if !q.Send(NewMsg(4, 0, nil)) || q.DroppedCount() != 1 {
+		t.Fatal("block send failed")
+	}
+}
+
+func TestSendPolicyDrop(t *testing.T) {
+	q := testFullMsgQue(&DefMsgHandler{}, SendPolicyDropNew, 0)
+	defer q.Stop()
+	if q.Send(NewMsg(3, 0, nil)) || q.DroppedCount() != 1 || len(q.cwrite) != 2 {
+		t.Fatal("drop new", q.DroppedCount())
+	}
+	if m := <-q.cwrite; m.Id() != 1 {
+		t.Fatal("drop new kept", m.Id())
+	}
+
+	q = testFullMsgQue(&DefMsgHandler{}, SendPolicyDropOld, 0)
+	defer q.Stop()
+	if !q.Send(NewMsg(3, 0, nil)) || q.DroppedCount() != 1 || len(q.cwrite) != 2 {
+		t.Fatal("drop old", q.DroppedCount())
+	}
+	if a, b := <-q.cwrite, <-q.cwrite; a.Id() != 2 || b.Id() != 3 {
+		t.Fatal("drop old kept", a.Id(), b.Id())
+	}
+}
+
+func TestSendPolicyClose(t *testing.T) {
+	q := testFullMsgQue(&DefMsgHandler{}, SendPolicyClose, 0)
+	if q.Send(NewMsg(3, 0, nil)) || q.DroppedCount() != 1 {
+		t.Fatal("close", q.DroppedCount())
+	}
+	for i := 0; i < 50 && !q.IsStop(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !q.IsStop() {
+		t.Fatal("slow consumer not closed")
+	}
+}
+
+//积压达到高水位时回调一次，降到一半以下后可再次触发
+func TestSendHighWater(t *testing.T) {
+	h := &testHighWaterHandler{}
+	q := newTcpConn("tcp", "127.0.0.1:1", nil, MsgTypeMsg, h, nil, nil)
+	defer q.Stop()
+	q.SetHighWater(4)
+	for i := 0; i < 6; i++ {
+		q.Send(NewMsg(1, 0, nil))
+	}
+	if atomic.LoadInt32(&h.hits) != 1 {
+		t.Fatal("hits", h.hits)
+	}
+	for len(q.cwrite) > 0 {
+		<-q.cwrite
+	}
+	q.Send(NewMsg(1, 0, nil))
+	for i := 0; i < 3; i++ {
+		q.Send(NewMsg(1, 0, nil))
+	}
+	if atomic.LoadInt32(&h.hits) != 2 {
+		t.Fatal("hits after drain", h.hits)
+	}
+}
+
+//写入通道已关闭时释放缓冲区的引用
+func TestPushWriteClosed(t *testing.T) {
+	defer testBufferDebug()()
+	q := &msgQue{cwrite: make(chan *Message, 1)}
+	close(q.cwrite)
+	m := NewMsg(1, 0, nil)
+	m.buf = newMsgBuffer(GetBuffer(64))
+	if q.pushWrite(m) {
+		t.Fatal("pushed to closed channel")
+	}
+	if ref := atomic.LoadInt32(&m.buf.ref); ref != 1 {
+		t.Fatal("ref", ref)
+	}
+	m.Release()
+}
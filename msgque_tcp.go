@@ -8,6 +8,8 @@ package easynet
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"sync"
@@ -24,6 +26,8 @@ type tcpMsgQue struct {
 	wait       sync.WaitGroup
 	connecting int32
 	rawBuffer  []byte
+	tlsConfig  *tls.Config //不为nil时使用tls
+	peerCred   *PeerCred   //unix socket对端凭证
 }
 
 func (r *tcpMsgQue) SetCmdReadRaw() {
@@ -36,10 +40,15 @@ func (r *tcpMsgQue) GetNetType() NetType {
 func (r *tcpMsgQue) Stop() {
 	if atomic.CompareAndSwapInt32(&r.stop, 0, 1) {
 		Go(func() {
+			if r.resumeDetach() {
+				return
+			}
 			if r.init {
 				r.handler.OnDelMsgQue(r)
+				r.reconnectByPolicy(r)
 				if r.connecting == 1 {
 					r.available = false
+					r.stopCalls()
 					return
 				}
 			}
@@ -77,47 +86,46 @@ func (r *tcpMsgQue) RemoteAddr() string {
 	return r.address
 }
 
-func (r *tcpMsgQue) readMsg() {
-	headData := make([]byte, MsgHeadSize)
-	var data []byte
-	var head *MessageHead
+func (r *tcpMsgQue) PeerCertificates() []*x509.Certificate {
+	if c, ok := r.conn.(*tls.Conn); ok {
+		return c.ConnectionState().PeerCertificates
+	}
+	return nil
+}
 
+func (r *tcpMsgQue) readMsg() {
+	reader := bufio.NewReaderSize(r.conn, Config.ReadDataBuffer)
+	codec := r.GetHeadCodec()
 	for !r.IsStop() {
-		if head == nil {
-			_, err := io.ReadFull(r.conn, headData)
-			if err != nil {
-				if err != io.EOF {
-					LogDebug("msgque:%v recv data err:%v", r.id, err)
-				}
-				break
-			}
-			if head = NewMessageHead(headData); head == nil {
-				LogError("msgque:%v read msg head failed", r.id)
-				break
+		head, err := codec.ReadHead(reader)
+		if err != nil {
+			if _, ok := err.(*Error); ok {
+				LogError("msgque:%v read msg head failed err:%v", r.id, err)
+			} else if err != io.EOF {
+				LogDebug("msgque:%v recv data err:%v", r.id, err)
 			}
-			if head.Len == 0 {
-				if !r.processMsg(r, &Message{Head: head}) {
-					LogError("msgque:%v process msg Id:%v", r.id, head.Id)
-					break
-				}
-				head = nil
+			break
+		}
+		msg := &Message{Head: head}
+		if head.Len > 0 {
+			if Config.MsgBufferPool {
+				msg.Data = GetBuffer(int(head.Len))
+				msg.buf = newMsgBuffer(msg.Data)
 			} else {
-				data = make([]byte, head.Len)
+				msg.Data = make([]byte, head.Len)
 			}
-		} else {
-			_, err := io.ReadFull(r.conn, data)
-			if err != nil {
+			if _, err := io.ReadFull(reader, msg.Data); err != nil {
 				LogError("msgque:%v recv data err:%v", r.id, err)
 				break
 			}
-
-			if !r.processMsg(r, &Message{Head: head, Data: data}) {
-				LogError("msgque:%v process msg id:%v", r.id, head.Id)
-				break
-			}
-
-			head = nil
-			data = nil
+		}
+		if err := codec.CheckData(head, msg.Data); err != nil {
+			LogError("msgque:%v check msg data failed id:%v err:%v", r.id, head.Id, err)
+			break
+		}
+		if !r.processMsg(r, msg) {
+			LogError("msgque:%v process msg id:%v", r.id, head.Id)
+			break
 		}
 		r.lastTick = Timestamp
 	}
@@ -126,6 +134,7 @@ func (r *tcpMsgQue) readMsg() {
 func (r *tcpMsgQue) writeMsgFast() {
 	var m *Message
 	var data []byte
+	pooled := false
 	gm := MsgqueBroadcast.GetNewMsg()
 	writeCount := 0
 	tick := time.NewTimer(time.Second * time.Duration(r.timeout))
@@ -135,12 +144,12 @@ func (r *tcpMsgQue) writeMsgFast() {
 			case <-stopChanForGo:
 			case m = <-r.cwrite:
 				if m != nil {
-					data = m.Bytes()
+					data, pooled = r.encodeMsg(m)
 				}
 			case <-gm.C:
 				msg := gm.GetMsg(r)
 				if msg != nil {
-					data = msg.(*Message).Bytes()
+					data = r.msgBytes(msg.(*Message))
 				}
 				gm = MsgqueBroadcast.GetNextMsg(gm)
 			case <-tick.C:
@@ -164,6 +173,10 @@ func (r *tcpMsgQue) writeMsgFast() {
 		}
 
 		if writeCount == len(data) {
+			if pooled {
+				PutBuffer(data)
+			}
+			m.Release()
 			writeCount = 0
 			m = nil
 		}
@@ -172,63 +185,121 @@ func (r *tcpMsgQue) writeMsgFast() {
 	tick.Stop()
 }
 
+//合并写入，取出写入通道和广播中已有的消息后一次写入
+//*net.TCPConn使用writev，tls等其他连接合并到缓冲区后写入
 func (r *tcpMsgQue) writeMsg() {
-	var m *Message
-	head := make([]byte, MsgHeadSize)
+	codec := r.GetHeadCodec()
 	gm := MsgqueBroadcast.GetNewMsg()
-	writeCount := 0
 	tick := time.NewTimer(time.Second * time.Duration(r.timeout))
-	for !r.IsStop() || m != nil {
-		if m == nil {
-			select {
-			case <-stopChanForGo:
-			case m = <-r.cwrite:
-				if m != nil {
-					m.Head.FastBytes(head)
-				}
-			case <-gm.C:
-				msg := gm.GetMsg(r)
-				if msg != nil {
-					m = msg.(*Message)
-					m.Head.FastBytes(head)
-				}
-				gm = MsgqueBroadcast.GetNextMsg(gm)
-			case <-tick.C:
-				if r.isTimeout(tick) {
-					r.Stop()
-				}
+	_, writev := r.conn.(*net.TCPConn)
+	var vec net.Buffers
+	var buf []byte
+	var heads []byte    //批量写入时消息头的缓冲区
+	var msgs []*Message //来自写入通道的消息，写入后释放
+	var delay *time.Timer
+	closed := false //写入通道已关闭
+	for !r.IsStop() && !closed {
+		var m *Message
+		owned := false
+		select {
+		case <-stopChanForGo:
+		case m, owned = <-r.cwrite:
+			closed = !owned
+		case <-gm.C:
+			if msg := gm.GetMsg(r); msg != nil {
+				m = msg.(*Message)
+			}
+			gm = MsgqueBroadcast.GetNextMsg(gm)
+		case <-tick.C:
+			if r.isTimeout(tick) {
+				r.Stop()
 			}
 		}
-
 		if m == nil {
 			continue
 		}
 
-		if writeCount < MsgHeadSize {
-			n, err := r.conn.Write(head[writeCount:])
-			if err != nil {
-				LogError("msgque write id:%v err:%v", r.id, err)
+		vec, buf, heads, msgs = vec[:0], buf[:0], heads[:0], msgs[:0]
+		size := 0
+		waited := Config.WriteBatchDelay <= 0
+		for m != nil || size < Config.WriteBatchSize {
+			if m != nil {
+				if writev {
+					//heads扩容后之前的消息头仍指向旧的数组，内容不变
+					pos := len(heads)
+					heads = codec.EncodeHead(heads, m.Head, m.Data)
+					vec = append(vec, heads[pos:])
+					if m.Head.Len > 0 {
+						vec = append(vec, m.Data[:m.Head.Len])
+					}
+					size += len(heads) - pos + int(m.Head.Len)
+				} else {
+					pos := len(buf)
+					buf = append(codec.EncodeHead(buf, m.Head, m.Data), m.Data[:m.Head.Len]...)
+					size += len(buf) - pos
+				}
+				if owned {
+					msgs = append(msgs, m)
+				}
+				m = nil
+				continue
+			}
+			if closed || r.IsStop() {
 				break
 			}
-			writeCount += n
-		}
-
-		if writeCount >= MsgHeadSize && m.Data != nil {
-			n, err := r.conn.Write(m.Data[writeCount-MsgHeadSize : int(m.Head.Len)])
-			if err != nil {
-				LogError("msgque write id:%v err:%v", r.id, err)
+			select {
+			case m, owned = <-r.cwrite:
+				closed = !owned
+				continue
+			case <-gm.C:
+				owned = false
+				if msg := gm.GetMsg(r); msg != nil {
+					m = msg.(*Message)
+				}
+				gm = MsgqueBroadcast.GetNextMsg(gm)
+				continue
+			default:
+			}
+			if waited {
 				break
 			}
-			writeCount += n
+			//等待更多消息，降低写入次数
+			waited = true
+			if delay == nil {
+				delay = time.NewTimer(time.Millisecond * time.Duration(Config.WriteBatchDelay))
+			} else {
+				delay.Reset(time.Millisecond * time.Duration(Config.WriteBatchDelay))
+			}
+			select {
+			case m, owned = <-r.cwrite:
+				closed = !owned
+				if !delay.Stop() {
+					<-delay.C
+				}
+			case <-delay.C:
+			}
 		}
 
-		if writeCount == int(m.Head.Len)+MsgHeadSize {
-			writeCount = 0
-			m = nil
+		var err error
+		if writev {
+			_, err = vec.WriteTo(r.conn)
+		} else {
+			_, err = r.conn.Write(buf)
+		}
+		for i, m := range msgs {
+			m.Release()
+			msgs[i] = nil
+		}
+		if err != nil {
+			LogError("msgque write id:%v err:%v", r.id, err)
+			break
 		}
 		r.lastTick = Timestamp
 	}
 	tick.Stop()
+	if delay != nil {
+		delay.Stop()
+	}
 }
 
 func (r *tcpMsgQue) readCmd() {
@@ -358,10 +429,35 @@ func (r *tcpMsgQue) listen() {
 			break
 		} else {
 			Go(func() {
-				c.(*net.TCPConn).SetNoDelay(Config.TCPNoDelay)
+				raw := c
+				realAddr := ""
+				if r.proxyProtocol != nil {
+					addr, err := r.proxyProtocol.read(c)
+					if err != nil {
+						LogError("proxy protocol failed msgque:%v addr:%v err:%v", r.id, c.RemoteAddr(), err)
+						c.Close()
+						return
+					}
+					realAddr = addr
+				}
+				if r.tlsConfig != nil {
+					tc := tls.Server(c, r.tlsConfig)
+					if err := tlsHandshake(tc); err != nil {
+						LogError("tls handshake failed msgque:%v addr:%v err:%v", r.id, c.RemoteAddr(), err)
+						c.Close()
+						return
+					}
+					c = tc
+				}
 				msgque := newTcpAccept(c, r.msgTyp, r.handler, r.parserFactory)
-				if r.handler.OnNewMsgQue(msgque) {
-					msgque.init = true
+				msgque.setConn(raw)
+				msgque.inherit(&r.msgQue)
+				if realAddr != "" {
+					msgque.SetRealRemoteAddr(realAddr)
+				}
+				//开启会话恢复时收到第一个消息后再回调OnNewMsgQue
+				if msgque.resumeWait || r.handler.OnNewMsgQue(msgque) {
+					msgque.init = !msgque.resumeWait
 					msgque.available = true
 					Go(func() {
 						LogInfo("process read for msgque:%d", msgque.id)
@@ -385,18 +481,34 @@ func (r *tcpMsgQue) listen() {
 }
 
 func (r *tcpMsgQue) connect() {
+	if r.isClosing() {
+		atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
+		return
+	}
 	LogDebug("connect to addr:%s msgque:%d", r.address, r.id)
 	c, err := net.DialTimeout(r.network, r.address, time.Second)
+	if err == nil {
+		r.setConn(c)
+		if r.tlsConfig != nil {
+			tc := tls.Client(c, r.tlsConfig)
+			if err = tlsHandshake(tc); err != nil {
+				c.Close()
+			}
+			c = tc
+		}
+	}
 	if err != nil {
 		LogError("connect to addr:%s failed msgque:%d err:%v", r.address, r.id, err)
 		r.handler.OnConnectComplete(r, false)
 		atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
 		r.Stop()
 	} else {
-		c.(*net.TCPConn).SetNoDelay(Config.TCPNoDelay)
 		r.conn = c
 		r.available = true
 		LogDebug("connect to addr:%s ok msgque:%d", r.address, r.id)
+		r.reconnectAttempts = 0
+		r.resumeConnect()
+		r.connectKeyExchange()
 		if r.handler.OnConnectComplete(r, true) {
 			atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
 			Go(func() {
@@ -417,6 +529,14 @@ func (r *tcpMsgQue) connect() {
 }
 
 func (r *tcpMsgQue) Reconnect(t int) {
+	if r.init && t < 1 {
+		t = 1
+	}
+	r.reconnectAfter(t * 1000)
+}
+
+//ms毫秒后重连
+func (r *tcpMsgQue) reconnectAfter(ms int) {
 	if IsStop() {
 		return
 	}
@@ -430,28 +550,21 @@ func (r *tcpMsgQue) Reconnect(t int) {
 		return
 	}
 
-	if r.init {
-		if t < 1 {
-			t = 1
-		}
-	}
 	r.init = true
-	Go(func() {
+	Go2(func(cstop chan struct{}) {
 		if len(r.cwrite) == 0 {
 			r.cwrite <- nil
 		}
 		r.wait.Wait()
-		if t > 0 {
-			SetTimeout(t*1000, func(arg ...interface{}) int {
-				r.stop = 0
-				r.connect()
-				return 0
-			})
-		} else {
+		if r.conn != nil {
+			r.resetKeyExchange()
+		}
+		if r.waitReconnect(ms, cstop) {
 			r.stop = 0
 			r.connect()
+		} else {
+			atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
 		}
-
 	})
 }
 
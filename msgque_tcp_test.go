@@ -0,0 +1,55 @@
+package easynet
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+//批量写入时写入通道被关闭，写入协程写出已合并的消息后退出
+func TestTcpWriteClosedChan(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+	q := &tcpMsgQue{msgQue: msgQue{id: 999998, cwrite: make(chan *Message, 4)}, conn: c1}
+	q.cwrite <- NewMsg(1, 0, []byte("a"))
+	q.cwrite <- NewMsg(2, 0, []byte("b"))
+	close(q.cwrite)
+	done := make(chan bool)
+	go func() {
+		q.writeMsg()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer did not exit after write channel closed")
+	}
+}
+
+//已停止时批量写入不再等待新的消息
+func TestTcpWriteStopped(t *testing.T) {
+	old := Config.WriteBatchDelay
+	Config.WriteBatchDelay = 5000
+	defer func() { Config.WriteBatchDelay = old }()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+	q := &tcpMsgQue{msgQue: msgQue{id: 999997, cwrite: make(chan *Message, 4)}, conn: c1}
+	q.cwrite <- NewMsg(1, 0, []byte("a"))
+	done := make(chan bool)
+	go func() {
+		q.writeMsg()
+		done <- true
+	}()
+	time.Sleep(50 * time.Millisecond)
+	q.stop = 1
+	close(q.cwrite)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer did not exit after stop")
+	}
+}
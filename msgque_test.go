@@ -0,0 +1,138 @@
+package easynet
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+//超过MaxMsgDataSize的消息拆分为FlagContinue分片，对端重组后交给处理函数
+func TestFragment(t *testing.T) {
+	if err := StartServer("tcp://127.0.0.1:29111", MsgTypeMsg, &testEchoHandler{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	c := StartConnect("tcp", "127.0.0.1:29111", MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+	defer c.Stop()
+	time.Sleep(100 * time.Millisecond)
+	data := make([]byte, int(MaxMsgDataSize)*3+100)
+	rand.Read(data)
+	m, err := c.Call(context.Background(), NewMsg(1, 0, data))
+	if err != nil || !bytes.Equal(m.Data, data) {
+		t.Fatal(err)
+	}
+}
+
+var testFragmentSender = &msgQue{packetSize: 100}
+
+//拆分消息，返回写入通道中的分片，同一个发送方的分片消息序号递增
+func testFragments(t *testing.T, id, index uint16, data []byte) []*Message {
+	q := testFragmentSender
+	q.cwrite = make(chan *Message, 64)
+	if !q.sendFragment(NewMsg(id, index, data)) {
+		t.Fatal("send fragment failed")
+	}
+	close(q.cwrite)
+	var frags []*Message
+	for m := range q.cwrite {
+		if m.Head.Flags&FlagContinue == 0 || int(m.Head.Len) != len(m.Data) {
+			t.Fatal("bad fragment", m.Head)
+		}
+		frags = append(frags, m)
+	}
+	return frags
+}
+
+//依次重组，返回重组完成的消息数据
+func testReassemble(t *testing.T, q *msgQue, msgs []*Message) []string {
+	var got []string
+	for i, m := range msgs {
+		m, ok := q.reassemble(m)
+		if !ok {
+			t.Fatalf("msg %d failed", i)
+		}
+		if m != nil {
+			got = append(got, string(m.Data))
+		}
+	}
+	return got
+}
+
+//不同Tag的分片交错到达
+func TestReassembleInterleaved(t *testing.T) {
+	a := bytes.Repeat([]byte("a"), 200)
+	b := bytes.Repeat([]byte("b"), 150)
+	fa, fb := testFragments(t, 1, 1, a), testFragments(t, 1, 2, b)
+	q := &msgQue{}
+	got := testReassemble(t, q, []*Message{fa[0], fb[0], fa[1], fb[1], NewMsg(1, 3, []byte("c")), fa[2]})
+	if len(got) != 3 || got[0] != string(b) || got[1] != "c" || got[2] != string(a) {
+		t.Fatal("got", got)
+	}
+	if q.fragment != nil || q.fragmentLen != 0 {
+		t.Fatal("fragment not cleared", q.fragmentLen)
+	}
+}
+
+//分片乱序和重复到达
+func TestReassembleReorder(t *testing.T) {
+	data := make([]byte, 500)
+	rand.Read(data)
+	frags := testFragments(t, 1, 0, data)
+	rand.Shuffle(len(frags), func(i, j int) { frags[i], frags[j] = frags[j], frags[i] })
+	frags = append(frags[:2], frags...)
+	q := &msgQue{}
+	got := testReassemble(t, q, frags)
+	if len(got) != 1 || got[0] != string(data) || q.fragment != nil {
+		t.Fatal("reorder", len(got))
+	}
+}
+
+//分片丢失时丢弃不完整的消息，不会把残留数据拼到后续消息上
+func TestReassembleLoss(t *testing.T) {
+	a := bytes.Repeat([]byte("a"), 300)
+	b := bytes.Repeat([]byte("b"), 300)
+	fa, fb := testFragments(t, 1, 0, a), testFragments(t, 1, 0, b)
+
+	//丢失最后一个分片，同一Tag的下一个分片消息正常重组
+	q := &msgQue{}
+	got := testReassemble(t, q, append(fa[:len(fa)-1:len(fa)-1], fb...))
+	if len(got) != 1 || got[0] != string(b) {
+		t.Fatal("lost last", got)
+	}
+
+	//丢失中间的分片，同一Tag的普通消息原样交付
+	q = &msgQue{}
+	fa = testFragments(t, 1, 0, a)
+	got = testReassemble(t, q, []*Message{fa[0], fa[2], NewMsg(1, 0, []byte("x")), fa[3]})
+	if len(got) != 1 || got[0] != "x" {
+		t.Fatal("lost middle", got)
+	}
+	if len(q.fragment) != 1 || q.fragmentLen != uint32(len(fa[3].Data)) {
+		t.Fatal("partial", len(q.fragment), q.fragmentLen)
+	}
+
+	//畸形的分片头关闭连接
+	bad := []*Message{
+		{Head: &MessageHead{Id: 1, Flags: FlagContinue, Len: 3}, Data: []byte("abc")},
+		{Head: &MessageHead{Id: 1, Flags: FlagContinue, Len: 8}, Data: []byte{0, 0, 0, 0, 2, 0, 2, 0}},
+	}
+	for i, m := range bad {
+		if _, ok := (&msgQue{}).reassemble(m); ok {
+			t.Fatalf("bad %d accepted", i)
+		}
+	}
+}
+
+//不可靠udp不拆分超长消息
+func TestUdpNoFragment(t *testing.T) {
+	q := &udpMsgQue{msgQue: msgQue{cwrite: make(chan *Message, 64)}}
+	q.setReliable(false)
+	if q.Send(NewMsg(1, 0, make([]byte, MaxUdpPacketSize))) || len(q.cwrite) != 0 {
+		t.Fatal("oversized udp msg sent")
+	}
+	q.setReliable(true)
+	if !q.Send(NewMsg(1, 0, make([]byte, MaxUdpPacketSize))) || len(q.cwrite) != 2 {
+		t.Fatal("rudp fragment", len(q.cwrite))
+	}
+}
@@ -0,0 +1,169 @@
+/*
+@Time       : 2022/6/26
+@Author     : wuqiusheng
+@File       : msgque_tls.go
+@Description: 消息队列，tcp的tls支持，每个监听可单独设置证书，支持双向认证
+*/
+package easynet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+var TlsHandshakeTimeout = 5 //tls握手超时 s
+
+//tls配置
+type TlsConfig struct {
+	CrtPath            string //证书路径，服务器必须设置，客户端设置后作为客户端证书
+	KeyPath            string //私钥路径
+	CaPath             string //ca证书路径，服务器设置后要求并校验客户端证书(双向认证)，客户端设置后用于校验服务器证书
+	ServerName         string //客户端校验的服务器名，为空时使用连接地址
+	InsecureSkipVerify bool   //客户端不校验服务器证书，仅用于测试
+}
+
+func (r *TlsConfig) loadCaPool() (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(r.CaPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, ErrConfigPath
+	}
+	return pool, nil
+}
+
+func (r *TlsConfig) serverConfig() (*tls.Config, error) {
+	if r.CrtPath == "" || r.KeyPath == "" {
+		return nil, ErrConfigPath
+	}
+	cert, err := tls.LoadX509KeyPair(r.CrtPath, r.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if r.CaPath != "" {
+		pool, err := r.loadCaPool()
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+func (r *TlsConfig) clientConfig(addr string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         r.ServerName,
+		InsecureSkipVerify: r.InsecureSkipVerify,
+	}
+	if conf.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			conf.ServerName = host
+		} else {
+			conf.ServerName = addr
+		}
+	}
+	if r.CrtPath != "" && r.KeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(r.CrtPath, r.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if r.CaPath != "" {
+		pool, err := r.loadCaPool()
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
+
+//tls握手，带超时
+func tlsHandshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(time.Second * time.Duration(TlsHandshakeTimeout)))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	return err
+}
+
+//启动tls服务，addr格式 tls://ip:port，conf为nil时使用Config.SSLCrtPath和Config.SSLKeyPath
+//需要同时设置其他参数时使用StartServerWithOptions和MsgQueOptions.Tls
+func StartTlsServer(addr string, typ MsgType, handler IMsgHandler, parser IParserFactory, conf *TlsConfig) error {
+	if !strings.Contains(addr, "://") {
+		addr = "tls://" + addr
+	}
+	return StartServerWithOptions(addr, typ, handler, parser, &MsgQueOptions{Tls: conf})
+}
+
+func startTlsServer(addr string, typ MsgType, handler IMsgHandler, parser IParserFactory, opts *MsgQueOptions) error {
+	var conf *TlsConfig
+	if opts != nil {
+		conf = opts.Tls
+	}
+	if conf == nil {
+		conf = &TlsConfig{CrtPath: Config.SSLCrtPath, KeyPath: Config.SSLKeyPath}
+	}
+	tlsConf, err := conf.serverConfig()
+	if err != nil {
+		LogError("listen on %s failed, tls config err:%v", addr, err)
+		return err
+	}
+	naddr := addr
+	if addrs := strings.Split(addr, "://"); len(addrs) > 1 {
+		naddr = addrs[1]
+	}
+	listen, err := net.Listen("tcp", naddr)
+	if err != nil {
+		LogError("listen on %s failed, errstr:%s", addr, err)
+		return err
+	}
+	msgque := newTcpListen(listen, typ, handler, parser, addr)
+	msgque.tlsConfig = tlsConf
+	msgque.setOptions(opts)
+	Go(func() {
+		LogDebug("process listen for tls msgque:%d", msgque.id)
+		msgque.listen()
+		LogDebug("process listen end for tls msgque:%d", msgque.id)
+	})
+	return nil
+}
+
+//连接tls服务，conf为nil时使用系统根证书校验服务器
+//需要同时设置其他参数时使用StartConnectWithOptions和MsgQueOptions.Tls
+func StartTlsConnect(addr string, typ MsgType, handler IMsgHandler, parser IParserFactory, user interface{}, conf *TlsConfig) IMsgQue {
+	return StartConnectWithOptions("tls", addr, typ, handler, parser, user, &MsgQueOptions{Tls: conf})
+}
+
+func startTlsConnect(addr string, typ MsgType, handler IMsgHandler, parser IParserFactory, user interface{}, opts *MsgQueOptions) IMsgQue {
+	var conf *TlsConfig
+	if opts != nil {
+		conf = opts.Tls
+	}
+	if conf == nil {
+		conf = &TlsConfig{}
+	}
+	tlsConf, err := conf.clientConfig(addr)
+	if err != nil {
+		LogError("connect to addr:%s failed, tls config err:%v", addr, err)
+		return nil
+	}
+	msgque := newTcpConn("tcp", addr, nil, typ, handler, parser, user)
+	msgque.tlsConfig = tlsConf
+	msgque.setOptions(opts)
+	if handler.OnNewMsgQue(msgque) {
+		msgque.Reconnect(0)
+		return msgque
+	} else {
+		msgque.Stop()
+	}
+	return nil
+}
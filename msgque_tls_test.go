@@ -0,0 +1,131 @@
+package easynet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//回应对端证书的CommonName
+type testTlsPeerHandler struct {
+	DefMsgHandler
+}
+
+func (r *testTlsPeerHandler) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	name := ""
+	if certs := msgque.PeerCertificates(); len(certs) > 0 {
+		name = certs[0].Subject.CommonName
+	}
+	msgque.Send(NewMsg(msg.Id(), msg.Index(), []byte(name)))
+	return true
+}
+
+//生成证书写入dir，parent为nil时自签名，返回证书路径、私钥路径和证书
+func testTlsCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return crt, keyPath, cert, key
+}
+
+//双向认证，服务器校验客户端证书，客户端校验服务器证书
+func TestTlsMutualAuth(t *testing.T) {
+	dir := t.TempDir()
+	caCrt, _, ca, caKey := testTlsCert(t, dir, "ca", nil, nil)
+	srvCrt, srvKey, _, _ := testTlsCert(t, dir, "server", ca, caKey)
+	cliCrt, cliKey, _, _ := testTlsCert(t, dir, "client", ca, caKey)
+	otherCrt, otherKey, _, _ := testTlsCert(t, dir, "other", nil, nil)
+
+	opts := &MsgQueOptions{Tls: &TlsConfig{CrtPath: srvCrt, KeyPath: srvKey, CaPath: caCrt}}
+	if err := StartServerWithOptions("tls://127.0.0.1:29171", MsgTypeMsg, &testTlsPeerHandler{}, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	c := StartTlsConnect("127.0.0.1:29171", MsgTypeMsg, &DefMsgHandler{}, nil, nil, &TlsConfig{CrtPath: cliCrt, KeyPath: cliKey, CaPath: caCrt})
+	defer c.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for i := 0; i < 50 && !c.Available(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	m, err := c.Call(ctx, NewMsg(1, 0, []byte("x")))
+	if err != nil || string(m.Data) != "client" {
+		t.Fatal("call", m, err)
+	}
+	if certs := c.PeerCertificates(); len(certs) == 0 || certs[0].Subject.CommonName != "server" {
+		t.Fatal("server cert", certs)
+	}
+
+	//客户端证书不是ca签发的，握手失败
+	h := &testConnectHandler{done: make(chan bool, 1)}
+	bad := StartTlsConnect("127.0.0.1:29171", MsgTypeMsg, h, nil, nil, &TlsConfig{CrtPath: otherCrt, KeyPath: otherKey, CaPath: caCrt})
+	defer bad.Stop()
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Second)
+	defer cancel2()
+	if _, err := bad.Call(ctx2, NewMsg(1, 0, []byte("x"))); err == nil {
+		t.Fatal("untrusted client cert accepted")
+	}
+
+	//不信任服务器证书的客户端连接失败
+	h = &testConnectHandler{done: make(chan bool, 1)}
+	StartTlsConnect("127.0.0.1:29171", MsgTypeMsg, h, nil, nil, &TlsConfig{CrtPath: cliCrt, KeyPath: cliKey, CaPath: otherCrt})
+	select {
+	case ok := <-h.done:
+		if ok {
+			t.Fatal("untrusted server cert accepted")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+type testConnectHandler struct {
+	DefMsgHandler
+	done chan bool
+}
+
+func (r *testConnectHandler) OnConnectComplete(msgque IMsgQue, ok bool) bool {
+	select {
+	case r.done <- ok:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,543 @@
+/*
+@Time       : 2022/6/20
+@Author     : wuqiusheng
+@File       : msgque_udp.go
+@Description: 消息队列，udp实现
+			一个数据报对应一条消息，消息格式与tcp一致(MessageHead+Data)
+			监听端按照远端地址将数据报分发到对应的消息队列
+			不可靠udp不拆分超长消息，超过数据报长度的消息发送失败，需要发送超长消息时使用rudp
+*/
+package easynet
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MaxUdpPacketSize = 65507 //udp数据报最大长度
+	udpReadChanSize  = 64    //每个远端的读取缓存
+)
+
+type udpMsgQue struct {
+	msgQue
+	conn       *net.UDPConn //连接，accept产生的消息队列与监听共用
+	peer       *net.UDPAddr //远端地址，仅accept产生的消息队列使用
+	cread      chan []byte  //读取通道，仅accept产生的消息队列使用
+	network    string
+	address    string
+	wait       sync.WaitGroup
+	connecting int32
+
+	listener *udpMsgQue            //所属监听
+	peerMap  map[string]*udpMsgQue //远端地址->消息队列，仅监听使用
+	peerLock sync.Mutex
+	maxPeers int //最大远端数量，0表示使用Config.UdpMaxPeers，仅监听使用
+
+	reliable bool     //是否为可靠udp
+	arq      *rudpArq //可靠udp的arq
+}
+
+func (r *udpMsgQue) GetNetType() NetType {
+	return NetTypeUdp
+}
+
+func (r *udpMsgQue) Stop() {
+	if atomic.CompareAndSwapInt32(&r.stop, 0, 1) {
+		Go(func() {
+			if r.init {
+				r.handler.OnDelMsgQue(r)
+				r.reconnectByPolicy(r)
+				if r.connecting == 1 {
+					r.available = false
+					r.stopCalls()
+					return
+				}
+			}
+			r.available = false
+			if r.listener != nil {
+				r.listener.delPeer(r)
+			}
+			r.baseStop()
+		})
+	}
+}
+
+func (r *udpMsgQue) IsStop() bool {
+	if r.stop == 0 {
+		if IsStop() {
+			r.Stop()
+		}
+	}
+	return r.stop == 1
+}
+
+func (r *udpMsgQue) LocalAddr() string {
+	if r.conn != nil {
+		return r.conn.LocalAddr().String()
+	}
+	return ""
+}
+
+func (r *udpMsgQue) RemoteAddr() string {
+	if r.realRemoteAddr != "" {
+		return r.realRemoteAddr
+	}
+	if r.peer != nil {
+		return r.peer.String()
+	}
+	if r.conn != nil && r.connTyp == ConnTypeConn {
+		return r.conn.RemoteAddr().String()
+	}
+	return r.address
+}
+
+//读取一个数据报，accept产生的消息队列从监听分发的通道读取
+func (r *udpMsgQue) readPacket(buf []byte) ([]byte, bool) {
+	if r.connTyp == ConnTypeAccept {
+		data, ok := <-r.cread
+		return data, ok
+	}
+	n, err := r.conn.Read(buf)
+	if err != nil {
+		if !r.IsStop() {
+			LogDebug("msgque:%v recv data err:%v", r.id, err)
+		}
+		return nil, false
+	}
+	data := make([]byte, n)
+	copy(data, buf[:n])
+	return data, true
+}
+
+//处理一个数据报中的消息
+func (r *udpMsgQue) processPacket(data []byte) bool {
+	if r.msgTyp == MsgTypeCmd {
+		return r.processMsg(r, &Message{Data: data})
+	}
+	msg, err := r.decodeMsg(data)
+	if err != nil {
+		LogError("msgque:%v decode msg failed len:%v err:%v", r.id, len(data), err)
+		return false
+	}
+	if !r.processMsg(r, msg) {
+		LogError("msgque:%v process msg id:%v", r.id, msg.Head.Id)
+		return false
+	}
+	return true
+}
+
+func (r *udpMsgQue) readMsg() {
+	var buf []byte
+	if r.connTyp != ConnTypeAccept {
+		buf = make([]byte, MaxUdpPacketSize)
+	}
+	for !r.IsStop() {
+		data, ok := r.readPacket(buf)
+		if !ok {
+			break
+		}
+		if r.arq != nil {
+			msgs, ok := r.arq.input(data)
+			if !ok {
+				LogError("msgque:%v rudp input failed len:%v", r.id, len(data))
+				break
+			}
+			r.arq.flushAck()
+			for _, v := range msgs {
+				if !r.processPacket(v) {
+					return
+				}
+			}
+		} else if !r.processPacket(data) {
+			break
+		}
+		r.lastTick = Timestamp
+	}
+}
+
+func (r *udpMsgQue) writePacket(data []byte) error {
+	if len(data) > MaxUdpPacketSize {
+		LogError("msgque:%v write packet too long len:%v", r.id, len(data))
+		return nil
+	}
+	var err error
+	if r.peer != nil {
+		_, err = r.conn.WriteToUDP(data, r.peer)
+	} else {
+		_, err = r.conn.Write(data)
+	}
+	return err
+}
+
+func (r *udpMsgQue) writeMsg() {
+	var m *Message
+	owned := false //来自写入通道的消息，写入后释放
+	var flush <-chan time.Time
+	if r.arq != nil {
+		ticker := time.NewTicker(time.Millisecond * time.Duration(Config.RudpInterval))
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+	gm := MsgqueBroadcast.GetNewMsg()
+	tick := time.NewTimer(time.Second * time.Duration(r.timeout))
+	for !r.IsStop() || m != nil {
+		if m == nil {
+			//可靠udp等待发送的分段过多时暂停读取写入通道，积压由发送策略处理
+			cwrite := r.cwrite
+			if r.arq != nil && r.arq.waitSnd() >= r.arq.sndQueueLimit() {
+				cwrite = nil
+			}
+			select {
+			case <-stopChanForGo:
+			case m = <-cwrite:
+				owned = true
+			case <-gm.C:
+				owned = false
+				msg := gm.GetMsg(r)
+				if msg != nil {
+					m = msg.(*Message)
+				}
+				gm = MsgqueBroadcast.GetNextMsg(gm)
+			case <-flush:
+				if !r.arq.flush() {
+					LogError("msgque:%v rudp dead link", r.id)
+					r.Stop()
+				}
+			case <-tick.C:
+				if r.isTimeout(tick) {
+					r.Stop()
+				}
+			}
+		}
+
+		if m == nil {
+			continue
+		}
+		if r.msgTyp == MsgTypeCmd && m.Data == nil {
+			m = nil
+			continue
+		}
+		var err error
+		if r.arq != nil {
+			if r.arq.send(r.msgBytes(m)) {
+				r.arq.flush()
+			} else {
+				LogError("msgque:%v rudp msg too long len:%v", r.id, m.Len())
+			}
+		} else {
+			err = r.writePacket(r.msgBytes(m))
+		}
+		if owned {
+			m.Release()
+		}
+		if err != nil {
+			LogError("msgque write id:%v err:%v", r.id, err)
+			break
+		}
+		m = nil
+		r.lastTick = Timestamp
+	}
+	tick.Stop()
+}
+
+func (r *udpMsgQue) read() {
+	defer func() {
+		r.wait.Done()
+		if err := recover(); err != nil {
+			LogError("msgque read panic id:%v err:%v", r.id, err.(error))
+			LogStack()
+		}
+		r.Stop()
+	}()
+
+	r.wait.Add(1)
+	r.readMsg()
+}
+
+func (r *udpMsgQue) write() {
+	defer func() {
+		r.wait.Done()
+		if err := recover(); err != nil {
+			LogError("msgque write panic id:%v err:%v", r.id, err.(error))
+			LogStack()
+		}
+		//accept产生的消息队列与监听共用连接，不能关闭
+		if r.conn != nil && r.connTyp == ConnTypeConn {
+			r.conn.Close()
+		}
+		r.Stop()
+	}()
+	r.wait.Add(1)
+	r.writeMsg()
+}
+
+//设置是否为可靠udp，同时根据数据报长度限制设置分片长度，不可靠udp不拆分超长消息
+func (r *udpMsgQue) setReliable(reliable bool) {
+	r.reliable = reliable
+	r.noFragment = !reliable
+	if reliable {
+		r.packetSize = RudpMaxMsgSize
+	} else {
+		r.packetSize = MaxUdpPacketSize
+	}
+}
+
+func (r *udpMsgQue) initArq() {
+	if r.reliable {
+		r.arq = newRudpArq(r.writePacket)
+	}
+}
+
+func (r *udpMsgQue) delPeer(peer *udpMsgQue) {
+	r.peerLock.Lock()
+	key := peer.peer.String()
+	if p, ok := r.peerMap[key]; ok && p == peer {
+		delete(r.peerMap, key)
+	}
+	close(peer.cread)
+	r.peerLock.Unlock()
+}
+
+func (r *udpMsgQue) peerLimit() int {
+	if r.maxPeers > 0 {
+		return r.maxPeers
+	}
+	return Config.UdpMaxPeers
+}
+
+//分发数据报，新的远端地址创建新的消息队列
+func (r *udpMsgQue) dispatch(addr *net.UDPAddr, data []byte) {
+	key := addr.String()
+	r.peerLock.Lock()
+	msgque, ok := r.peerMap[key]
+	if ok {
+		select {
+		case msgque.cread <- data:
+		default:
+			LogWarn("[msgque]udp read channel full drop packet msgque:%v", msgque.id)
+		}
+		r.peerLock.Unlock()
+		return
+	}
+	if max := r.peerLimit(); max > 0 && len(r.peerMap) >= max {
+		r.peerLock.Unlock()
+		LogDebug("[msgque]udp peers reach limit:%v drop packet from:%v msgque:%v", max, key, r.id)
+		return
+	}
+	msgque = newUdpAccept(r.conn, addr, r.msgTyp, r.handler, r.parserFactory)
+	msgque.listener = r
+	msgque.setReliable(r.reliable)
+	msgque.inherit(&r.msgQue)
+	msgque.initArq()
+	msgque.cread <- data
+	r.peerMap[key] = msgque
+	r.peerLock.Unlock()
+
+	Go(func() {
+		if r.handler.OnNewMsgQue(msgque) {
+			msgque.init = true
+			msgque.available = true
+			Go(func() {
+				LogInfo("process read for msgque:%d", msgque.id)
+				msgque.read()
+				LogInfo("process read end for msgque:%d", msgque.id)
+			})
+			Go(func() {
+				LogInfo("process write for msgque:%d", msgque.id)
+				msgque.write()
+				LogInfo("process write end for msgque:%d", msgque.id)
+			})
+		} else {
+			msgque.Stop()
+		}
+	})
+}
+
+func (r *udpMsgQue) listen() {
+	c := make(chan struct{})
+	Go2(func(cstop chan struct{}) {
+		select {
+		case <-cstop:
+		case <-c:
+		}
+		r.conn.Close()
+	})
+	buf := make([]byte, MaxUdpPacketSize)
+	for !r.IsStop() {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if stop == 0 && r.stop == 0 {
+				LogError("udp read failed msgque:%v err:%v", r.id, err)
+			}
+			break
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		r.dispatch(addr, data)
+	}
+
+	close(c)
+	r.peerLock.Lock()
+	for _, v := range r.peerMap {
+		v.Stop()
+	}
+	r.peerLock.Unlock()
+	r.Stop()
+}
+
+func (r *udpMsgQue) connect() {
+	if r.isClosing() {
+		atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
+		return
+	}
+	LogDebug("connect to addr:%s msgque:%d", r.address, r.id)
+	addr, err := net.ResolveUDPAddr(r.network, r.address)
+	var c *net.UDPConn
+	if err == nil {
+		c, err = net.DialUDP(r.network, nil, addr)
+	}
+	if err != nil {
+		LogError("connect to addr:%s failed msgque:%d err:%v", r.address, r.id, err)
+		r.handler.OnConnectComplete(r, false)
+		atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
+		r.Stop()
+	} else {
+		r.conn = c
+		r.available = true
+		r.initArq()
+		LogDebug("connect to addr:%s ok msgque:%d", r.address, r.id)
+		r.reconnectAttempts = 0
+		r.connectKeyExchange()
+		if r.handler.OnConnectComplete(r, true) {
+			atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
+			Go(func() {
+				LogInfo("process read for msgque:%d", r.id)
+				r.read()
+				LogInfo("process read end for msgque:%d", r.id)
+			})
+			Go(func() {
+				LogInfo("process write for msgque:%d", r.id)
+				r.write()
+				LogInfo("process write end for msgque:%d", r.id)
+			})
+		} else {
+			atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
+			r.Stop()
+		}
+	}
+}
+
+func (r *udpMsgQue) Reconnect(t int) {
+	if r.init && t < 1 {
+		t = 1
+	}
+	r.reconnectAfter(t * 1000)
+}
+
+//ms毫秒后重连
+func (r *udpMsgQue) reconnectAfter(ms int) {
+	if IsStop() {
+		return
+	}
+	if r.conn != nil {
+		if r.stop == 0 {
+			return
+		}
+	}
+
+	if !atomic.CompareAndSwapInt32(&r.connecting, 0, 1) {
+		return
+	}
+
+	r.init = true
+	Go2(func(cstop chan struct{}) {
+		if len(r.cwrite) == 0 {
+			r.cwrite <- nil
+		}
+		r.wait.Wait()
+		if r.conn != nil {
+			r.resetKeyExchange()
+		}
+		if r.waitReconnect(ms, cstop) {
+			r.stop = 0
+			r.connect()
+		} else {
+			atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
+		}
+	})
+}
+
+func newUdpConn(network, addr string, msgtyp MsgType, handler IMsgHandler, parser IParserFactory, user interface{}) *udpMsgQue {
+	msgque := udpMsgQue{
+		msgQue: msgQue{
+			id:            atomic.AddUint32(&msgqueId, 1),
+			cwrite:        make(chan *Message, 64),
+			msgTyp:        msgtyp,
+			handler:       handler,
+			timeout:       DefMsgQueTimeout,
+			connTyp:       ConnTypeConn,
+			parserFactory: parser,
+			lastTick:      Timestamp,
+			user:          user,
+		},
+		network: network,
+		address: addr,
+	}
+	if parser != nil {
+		msgque.parser = parser.Get()
+	}
+	msgqueMapSync.Lock()
+	msgqueMap[msgque.id] = &msgque
+	msgqueMapSync.Unlock()
+	LogDebug("new msgque id:%d connect to addr:%s:%s", msgque.id, network, addr)
+	return &msgque
+}
+
+func newUdpAccept(conn *net.UDPConn, peer *net.UDPAddr, msgtyp MsgType, handler IMsgHandler, parser IParserFactory) *udpMsgQue {
+	msgque := udpMsgQue{
+		msgQue: msgQue{
+			id:            atomic.AddUint32(&msgqueId, 1),
+			cwrite:        make(chan *Message, 64),
+			msgTyp:        msgtyp,
+			handler:       handler,
+			timeout:       DefMsgQueTimeout,
+			connTyp:       ConnTypeAccept,
+			lastTick:      Timestamp,
+			parserFactory: parser,
+		},
+		conn:  conn,
+		peer:  peer,
+		cread: make(chan []byte, udpReadChanSize),
+	}
+	if parser != nil {
+		msgque.parser = parser.Get()
+	}
+	msgqueMapSync.Lock()
+	msgqueMap[msgque.id] = &msgque
+	msgqueMapSync.Unlock()
+	LogInfo("new msgque id:%d from addr:%s", msgque.id, peer.String())
+	return &msgque
+}
+
+func newUdpListen(conn *net.UDPConn, msgtyp MsgType, handler IMsgHandler, parser IParserFactory, addr string) *udpMsgQue {
+	msgque := udpMsgQue{
+		msgQue: msgQue{
+			id:            atomic.AddUint32(&msgqueId, 1),
+			msgTyp:        msgtyp,
+			handler:       handler,
+			parserFactory: parser,
+			connTyp:       ConnTypeListen,
+		},
+		conn:    conn,
+		peerMap: map[string]*udpMsgQue{},
+	}
+
+	msgqueMapSync.Lock()
+	msgqueMap[msgque.id] = &msgque
+	msgqueMapSync.Unlock()
+	LogInfo("new udp listen id:%d addr:%s", msgque.id, addr)
+	return &msgque
+}
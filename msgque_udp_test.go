@@ -0,0 +1,35 @@
+package easynet
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testEchoHandler struct {
+	DefMsgHandler
+}
+
+func (r *testEchoHandler) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	msgque.Send(NewMsg(msg.Id(), msg.Index(), append([]byte(nil), msg.Data...)))
+	return true
+}
+
+func TestUdpMaxPeers(t *testing.T) {
+	if err := StartServerWithOptions("udp://127.0.0.1:29101", MsgTypeMsg, &testEchoHandler{}, nil, &MsgQueOptions{MaxPeers: 1}); err != nil {
+		t.Fatal(err)
+	}
+	a := StartConnect("udp", "127.0.0.1:29101", MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+	b := StartConnect("udp", "127.0.0.1:29101", MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+	defer a.Stop()
+	defer b.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if m, err := a.Call(context.Background(), NewMsg(1, 0, []byte("a"))); err != nil || string(m.Data) != "a" {
+		t.Fatal(m, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := b.Call(ctx, NewMsg(1, 0, []byte("b"))); err == nil {
+		t.Fatal("peer over limit should be dropped")
+	}
+}
@@ -0,0 +1,85 @@
+/*
+@Time       : 2022/8/15
+@Author     : wuqiusheng
+@File       : msgque_unix.go
+@Description: unix domain socket，复用tcp消息队列的读写，用于同一主机的服务之间
+			监听地址 unix:///tmp/game.sock，以@开头的路径为linux抽象命名空间，如 unix://@game
+			连接时netType为unix，addr为路径，也可以带unix://前缀
+			linux下通过SO_PEERCRED获取对端进程的pid、uid、gid
+*/
+package easynet
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+//unix socket对端进程凭证
+type PeerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+func unixPath(addr string) string {
+	return strings.TrimPrefix(addr, "unix://")
+}
+
+//删除没有进程监听的socket文件，避免进程异常退出后无法再次监听
+func removeStaleUnixSocket(path string) {
+	if path == "" || path[0] == '@' {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return
+	}
+	LogWarn("remove stale unix socket:%s", path)
+	os.Remove(path)
+}
+
+func startUnixServer(addr string, typ MsgType, handler IMsgHandler, parser IParserFactory, opts *MsgQueOptions) error {
+	path := unixPath(addr)
+	removeStaleUnixSocket(path)
+	listen, err := net.Listen("unix", path)
+	if err != nil {
+		LogError("listen on %s failed, errstr:%s", addr, err)
+		return err
+	}
+	msgque := newTcpListen(listen, typ, handler, parser, addr)
+	msgque.setOptions(opts)
+	Go(func() {
+		LogDebug("process listen for unix msgque:%d", msgque.id)
+		msgque.listen()
+		LogDebug("process listen end for unix msgque:%d", msgque.id)
+	})
+	return nil
+}
+
+func (r *msgQue) PeerCred() *PeerCred {
+	return nil
+}
+
+func (r *tcpMsgQue) PeerCred() *PeerCred {
+	return r.peerCred
+}
+
+//设置连接参数，tcp连接设置NoDelay，unix连接读取对端凭证
+func (r *tcpMsgQue) setConn(c net.Conn) {
+	switch conn := c.(type) {
+	case *net.TCPConn:
+		conn.SetNoDelay(Config.TCPNoDelay)
+	case *net.UnixConn:
+		cred, err := getPeerCred(conn)
+		if err != nil {
+			LogWarn("get peer cred failed msgque:%v err:%v", r.id, err)
+		}
+		r.peerCred = cred
+	}
+}
@@ -0,0 +1,31 @@
+/*
+@Time       : 2022/8/15
+@Author     : wuqiusheng
+@File       : msgque_unix_linux.go
+@Description: linux下通过SO_PEERCRED获取unix socket对端凭证
+*/
+package easynet
+
+import (
+	"net"
+	"syscall"
+)
+
+func getPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &PeerCred{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}, nil
+}
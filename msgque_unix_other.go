@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+/*
+@Time       : 2022/8/15
+@Author     : wuqiusheng
+@File       : msgque_unix_other.go
+@Description: 非linux系统不支持获取unix socket对端凭证
+*/
+package easynet
+
+import (
+	"net"
+)
+
+func getPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, nil
+}
@@ -0,0 +1,78 @@
+package easynet
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+//记录accept的消息队列的对端凭证
+type testUnixCredHandler struct {
+	testEchoHandler
+	cred chan *PeerCred
+}
+
+func (r *testUnixCredHandler) OnNewMsgQue(msgque IMsgQue) bool {
+	r.cred <- msgque.PeerCred()
+	return true
+}
+
+//unix socket收发消息，linux下双方都能获取对端凭证，支持抽象命名空间
+func TestUnix(t *testing.T) {
+	addrs := []string{"unix://" + filepath.Join(t.TempDir(), "easynet.sock")}
+	if runtime.GOOS == "linux" {
+		addrs = append(addrs, "unix://@easynet_test")
+	}
+	for _, addr := range addrs {
+		h := &testUnixCredHandler{cred: make(chan *PeerCred, 1)}
+		if err := StartServer(addr, MsgTypeMsg, h, nil); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		c := StartConnect("unix", addr, MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+		defer c.Stop()
+		for i := 0; i < 50 && !c.Available(); i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		if m, err := c.Call(ctx, NewMsg(1, 0, []byte("hi"))); err != nil || string(m.Data) != "hi" {
+			t.Fatal(addr, m, err)
+		}
+		cred := <-h.cred
+		if runtime.GOOS != "linux" {
+			continue
+		}
+		if cred == nil || int(cred.Pid) != os.Getpid() || int(cred.Uid) != os.Getuid() || int(cred.Gid) != os.Getgid() {
+			t.Fatal("server cred", cred)
+		}
+		if cred := c.PeerCred(); cred == nil || int(cred.Pid) != os.Getpid() {
+			t.Fatal("client cred", cred)
+		}
+	}
+}
+
+//进程异常退出留下的socket文件在监听时删除
+func TestUnixStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stale.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("socket file removed", err)
+	}
+	if err := StartServer("unix://"+path, MsgTypeMsg, &testEchoHandler{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	//有进程监听的socket文件不删除
+	if err := StartServer("unix://"+path, MsgTypeMsg, &testEchoHandler{}, nil); err == nil {
+		t.Fatal("listening socket removed")
+	}
+}
@@ -7,8 +7,11 @@
 package easynet
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/gorilla/websocket"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -22,9 +25,23 @@ type wsMsgQue struct {
 	url        string
 	wait       sync.WaitGroup
 	connecting int32
-	listener   *http.Server
+	server     *wsServer //监听所在的端口或外部mux
 }
 
+//ws监听的端口或外部mux，同一端口的多个路径共享http服务，每个路径对应一个监听的消息队列
+//监听端口时由自身按路径分发请求，端口上没有路径时关闭http服务
+type wsServer struct {
+	addr   string
+	server *http.Server   //监听端口时有效
+	mux    *http.ServeMux //挂载到外部mux时有效
+	paths  map[string]*wsMsgQue
+	routes map[string]bool //已在外部mux上注册的路径，mux不能注销路径，停止后重新监听时复用
+}
+
+var wsServers = map[string]*wsServer{}
+var wsMuxServers = map[*http.ServeMux]*wsServer{}
+var wsServersSync sync.Mutex
+
 func (r *wsMsgQue) GetNetType() NetType {
 	return NetTypeWs
 }
@@ -32,10 +49,20 @@ func (r *wsMsgQue) GetNetType() NetType {
 func (r *wsMsgQue) Stop() {
 	if atomic.CompareAndSwapInt32(&r.stop, 0, 1) {
 		Go(func() {
+			if r.resumeDetach() {
+				return
+			}
 			if r.init {
 				r.handler.OnDelMsgQue(r)
+				r.reconnectByPolicy(r)
+				if r.connecting == 1 {
+					r.available = false
+					r.stopCalls()
+					return
+				}
 			}
 			r.available = false
+			r.unregister()
 			r.baseStop()
 		})
 	}
@@ -67,25 +94,69 @@ func (r *wsMsgQue) RemoteAddr() string {
 	return ""
 }
 
+func (r *wsMsgQue) PeerCertificates() []*x509.Certificate {
+	if r.conn == nil {
+		return nil
+	}
+	if c, ok := r.conn.UnderlyingConn().(*tls.Conn); ok {
+		return c.ConnectionState().PeerCertificates
+	}
+	return nil
+}
+
 func (r *wsMsgQue) readMsg() {
 	for !r.IsStop() {
-		_, data, err := r.conn.ReadMessage()
+		data, pooled, err := r.readMessage()
 		if err != nil {
+			r.onReadErr(err)
 			LogError("msgque:%v recv data err:%v", r.id, err)
 			break
 		}
-		msgHead := &MessageHead{}
-		msgHead.FromBytes(data)
-		if !r.processMsg(r, &Message{Head: msgHead, Data: data[MsgHeadSize:]}) {
+		msg, err := r.decodeFrame(data)
+		if err != nil {
+			var ok bool
+			if msg, ok = r.onMalformedFrame(data, err); !ok {
+				break
+			}
+			if msg == nil {
+				if pooled {
+					PutBuffer(data)
+				}
+				continue
+			}
+		}
+		//文本帧解析后不再引用缓冲区
+		if pooled && r.textMode() && msg.Head != nil {
+			PutBuffer(data)
+		} else if pooled {
+			msg.buf = newMsgBuffer(data)
+		}
+		if !r.processMsg(r, msg) {
 			break
 		}
 		r.lastTick = Timestamp
 	}
 }
+
+//开启缓冲区池时读取到缓冲区中
+func (r *wsMsgQue) readMessage() ([]byte, bool, error) {
+	if !Config.MsgBufferPool {
+		_, data, err := r.conn.ReadMessage()
+		return data, false, err
+	}
+	_, reader, err := r.conn.NextReader()
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := readBuffer(reader, Config.ReadDataBuffer)
+	return data, err == nil, err
+}
+
 func (r *wsMsgQue) readCmd() {
 	for !r.IsStop() {
 		_, data, err := r.conn.ReadMessage()
 		if err != nil {
+			r.onReadErr(err)
 			LogError("msgque:%v recv data err:%v", r.id, err)
 			break
 		}
@@ -102,6 +173,7 @@ func (r *wsMsgQue) writeMsg() {
 
 func (r *wsMsgQue) writeCmd() {
 	var m *Message
+	owned := false //来自写入通道的消息，写入后释放
 	gm := MsgqueBroadcast.GetNewMsg()
 	tick := time.NewTimer(time.Second * time.Duration(r.timeout))
 	for !r.IsStop() || m != nil {
@@ -109,7 +181,9 @@ func (r *wsMsgQue) writeCmd() {
 			select {
 			case <-stopChanForGo:
 			case m = <-r.cwrite:
+				owned = true
 			case <-gm.C:
+				owned = false
 				msg := gm.GetMsg(r)
 				if msg != nil {
 					m = msg.(*Message)
@@ -126,7 +200,16 @@ func (r *wsMsgQue) writeCmd() {
 			m = nil
 			continue
 		}
-		err := r.conn.WriteMessage(websocket.BinaryMessage, m.Bytes())
+		frame, data, pooled, err := r.encodeFrame(m)
+		if err == nil {
+			err = r.conn.WriteMessage(frame, data)
+		}
+		if pooled {
+			PutBuffer(data)
+		}
+		if owned {
+			m.Release()
+		}
 		if err != nil {
 			LogError("msgque write id:%v err:%v", r.id, err)
 			break
@@ -170,74 +253,285 @@ func (r *wsMsgQue) write() {
 	}
 }
 
-func (r *wsMsgQue) listen() {
-	Go2(func(cstop chan struct{}) {
-		select {
-		case <-cstop:
+//监听停止时注销路径，端口上没有路径时关闭http服务
+func (r *wsMsgQue) unregister() {
+	s := r.server
+	if s == nil {
+		return
+	}
+	wsServersSync.Lock()
+	defer wsServersSync.Unlock()
+	if s.paths[r.url] == r {
+		delete(s.paths, r.url)
+	}
+	if len(s.paths) == 0 && s.server != nil && wsServers[s.addr] == s {
+		LogInfo("ws server close because no path addr:%s", s.addr)
+		delete(wsServers, s.addr)
+		s.server.Close()
+	}
+}
+
+//在外部mux上注册路径，已注册过的路径复用之前的注册，mux上有其他处理器使用相同路径时返回错误
+func (r *wsServer) route(msgque *wsMsgQue) (err error) {
+	url := msgque.url
+	wsServersSync.Lock()
+	if r.routes[url] {
+		wsServersSync.Unlock()
+		return nil
+	}
+	r.routes[url] = true
+	wsServersSync.Unlock()
+	defer func() {
+		if e := recover(); e != nil {
+			LogError("ws handle url:%v failed msgque:%v err:%v", url, msgque.id, e)
+			wsServersSync.Lock()
+			delete(r.routes, url)
+			wsServersSync.Unlock()
+			err = ErrWsPathExist
 		}
-		r.listener.Close()
+	}()
+	r.mux.HandleFunc(url, func(hw http.ResponseWriter, hr *http.Request) {
+		r.serveHttp(hw, hr, url)
 	})
+	return nil
+}
 
-	r.upgrader = &websocket.Upgrader{
-		ReadBufferSize:  4096,
-		WriteBufferSize: 4096,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+//分发请求到路径当前的监听，路径已注销时返回404
+func (r *wsServer) serveHttp(hw http.ResponseWriter, hr *http.Request, url string) {
+	wsServersSync.Lock()
+	msgque := r.paths[url]
+	wsServersSync.Unlock()
+	if msgque == nil {
+		http.NotFound(hw, hr)
+		return
 	}
+	msgque.serveHttp(hw, hr)
+}
 
-	http.HandleFunc(r.url, func(hw http.ResponseWriter, hr *http.Request) {
-		c, err := r.upgrader.Upgrade(hw, hr, nil)
-		if err != nil {
-			if stop == 0 && r.stop == 0 {
-				LogError("accept failed msgque:%v err:%v", r.id, err)
-			}
-		} else {
+//监听端口时的http处理器，按路径分发请求
+func (r *wsServer) ServeHTTP(hw http.ResponseWriter, hr *http.Request) {
+	wsServersSync.Lock()
+	msgque := r.match(hr.URL.Path)
+	wsServersSync.Unlock()
+	if msgque == nil {
+		http.NotFound(hw, hr)
+		return
+	}
+	msgque.serveHttp(hw, hr)
+}
+
+//查找路径对应的监听，规则同http.ServeMux，以/结尾的路径匹配子路径，最长的优先，需要持有wsServersSync
+func (r *wsServer) match(path string) *wsMsgQue {
+	if msgque, ok := r.paths[path]; ok {
+		return msgque
+	}
+	var found *wsMsgQue
+	n := 0
+	for url, msgque := range r.paths {
+		if len(url) > n && strings.HasSuffix(url, "/") && strings.HasPrefix(path, url) {
+			found, n = msgque, len(url)
+		}
+	}
+	return found
+}
+
+func (r *wsMsgQue) serveHttp(hw http.ResponseWriter, hr *http.Request) {
+	if r.IsStop() {
+		http.NotFound(hw, hr)
+		return
+	}
+	//Origin不在白名单时不回调OnUpgrade
+	if !r.wsOpts.checkOrigin(hr) {
+		LogInfo("upgrade origin rejected msgque:%v addr:%v origin:%v", r.id, hr.RemoteAddr, hr.Header.Get("Origin"))
+		http.Error(hw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	var user interface{}
+	if r.wsOpts != nil && r.wsOpts.OnUpgrade != nil {
+		var err error
+		if user, err = r.wsOpts.OnUpgrade(hr); err != nil {
+			LogInfo("upgrade rejected msgque:%v addr:%v err:%v", r.id, hr.RemoteAddr, err)
+			http.Error(hw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	c, err := r.upgrader.Upgrade(hw, hr, nil)
+	if err != nil {
+		if stop == 0 && r.stop == 0 {
+			LogError("accept failed msgque:%v err:%v", r.id, err)
+		}
+		return
+	}
+	r.wsOpts.setConn(c, r.msgTyp)
+	Go(func() {
+		msgque := newWsAccept(c, r.msgTyp, r.handler, r.parserFactory)
+		msgque.inherit(&r.msgQue)
+		if user != nil {
+			msgque.SetUser(user)
+		}
+		//开启会话恢复时收到第一个消息后再回调OnNewMsgQue
+		if msgque.resumeWait || r.handler.OnNewMsgQue(msgque) {
+			msgque.init = !msgque.resumeWait
+			msgque.available = true
 			Go(func() {
-				msgque := newWsAccept(c, r.msgTyp, r.handler, r.parserFactory)
-				if r.handler.OnNewMsgQue(msgque) {
-					msgque.init = true
-					msgque.available = true
-					Go(func() {
-						LogInfo("process read for msgque:%d", msgque.id)
-						msgque.read()
-						LogInfo("process read end for msgque:%d", msgque.id)
-					})
-					Go(func() {
-						LogInfo("process write for msgque:%d", msgque.id)
-						msgque.write()
-						LogInfo("process write end for msgque:%d", msgque.id)
-					})
-				} else {
-					msgque.Stop()
-				}
+				LogInfo("process read for msgque:%d", msgque.id)
+				msgque.read()
+				LogInfo("process read end for msgque:%d", msgque.id)
 			})
+			Go(func() {
+				LogInfo("process write for msgque:%d", msgque.id)
+				msgque.write()
+				LogInfo("process write end for msgque:%d", msgque.id)
+			})
+		} else {
+			msgque.Stop()
+		}
+	})
+}
+
+//启动端口的http服务，同一端口只有第一个路径的监听调用
+func (r *wsServer) listen() {
+	Go2(func(cstop chan struct{}) {
+		select {
+		case <-cstop:
 		}
+		r.server.Close()
 	})
 
+	var err error
 	if Config.EnableWss {
 		if Config.SSLCrtPath != "" && Config.SSLKeyPath != "" {
-			r.listener.ListenAndServeTLS(Config.SSLCrtPath, Config.SSLKeyPath)
+			err = r.server.ListenAndServeTLS(Config.SSLCrtPath, Config.SSLKeyPath)
 		} else {
 			LogError("start wss failed ssl path not set please set now auto change to ws")
-			r.listener.ListenAndServe()
+			err = r.server.ListenAndServe()
 		}
 	} else {
-		r.listener.ListenAndServe()
+		err = r.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		LogError("ws listen on %s failed err:%v", r.addr, err)
+	}
+	wsServersSync.Lock()
+	if wsServers[r.addr] == r {
+		delete(wsServers, r.addr)
+	}
+	paths := r.paths
+	wsServersSync.Unlock()
+	for _, msgque := range paths {
+		msgque.Stop()
+	}
+}
+
+//获取端口的http服务，不存在时创建，返回是否新建，需要持有wsServersSync
+func getWsServer(addr string) (*wsServer, bool) {
+	if server, ok := wsServers[addr]; ok {
+		return server, false
+	}
+	server := &wsServer{
+		addr:  addr,
+		paths: map[string]*wsMsgQue{},
+	}
+	server.server = &http.Server{Addr: addr, Handler: server}
+	wsServers[addr] = server
+	return server, true
+}
+
+//获取外部mux对应的路由，不存在时创建，需要持有wsServersSync
+func getWsMuxServer(mux *http.ServeMux) *wsServer {
+	if server, ok := wsMuxServers[mux]; ok {
+		return server
+	}
+	server := &wsServer{
+		mux:    mux,
+		paths:  map[string]*wsMsgQue{},
+		routes: map[string]bool{},
+	}
+	wsMuxServers[mux] = server
+	return server
+}
+
+//添加路径的监听，路径已存在时返回错误，需要持有wsServersSync
+func (r *wsServer) add(msgque *wsMsgQue) error {
+	if _, ok := r.paths[msgque.url]; ok {
+		return ErrWsPathExist
+	}
+	msgque.server = r
+	r.paths[msgque.url] = msgque
+	return nil
+}
+
+//在端口上监听路径，同一端口的多个路径共享http服务
+func startWsServer(addr, url string, typ MsgType, handler IMsgHandler, parser IParserFactory, opts *MsgQueOptions) error {
+	msgque := newWsListen(addr, url, typ, handler, parser)
+	msgque.setOptions(opts)
+	msgque.upgrader = msgque.wsOpts.upgrader()
+	wsServersSync.Lock()
+	server, isNew := getWsServer(addr)
+	err := server.add(msgque)
+	wsServersSync.Unlock()
+	if err != nil {
+		LogError("listen on %s%s failed, path already exist", addr, url)
+		msgque.Stop()
+		return err
 	}
+	if isNew {
+		Go(func() {
+			LogDebug("process listen for ws addr:%s", addr)
+			server.listen()
+			LogDebug("process listen end for ws addr:%s", addr)
+		})
+	}
+	return nil
+}
+
+//在已有的mux上挂载ws路径，用于与http服务共用端口
+func startWsHandler(mux *http.ServeMux, url string, typ MsgType, handler IMsgHandler, parser IParserFactory, opts *MsgQueOptions) error {
+	msgque := newWsListen("", url, typ, handler, parser)
+	msgque.setOptions(opts)
+	msgque.upgrader = msgque.wsOpts.upgrader()
+	wsServersSync.Lock()
+	server := getWsMuxServer(mux)
+	err := server.add(msgque)
+	wsServersSync.Unlock()
+	if err != nil {
+		LogError("handle url %s failed, path already exist", url)
+		msgque.Stop()
+		return err
+	}
+	if err := server.route(msgque); err != nil {
+		msgque.Stop()
+		return err
+	}
+	Go2(func(cstop chan struct{}) {
+		select {
+		case <-cstop:
+		}
+		msgque.Stop()
+	})
+	return nil
 }
+
 func (r *wsMsgQue) connect() {
+	if r.isClosing() {
+		atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
+		return
+	}
 	LogInfo("connect to addr:%s msgque:%d", r.addr, r.id)
-	c, _, err := websocket.DefaultDialer.Dial(r.addr, nil)
+	c, _, err := r.wsOpts.dialer().Dial(r.addr, r.wsOpts.header())
 	if err != nil {
 		LogInfo("connect to addr:%s failed msgque:%d err:%v ", r.addr, r.id, err)
 		r.handler.OnConnectComplete(r, false)
 		atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
 		r.Stop()
 	} else {
+		r.wsOpts.setConn(c, r.msgTyp)
 		r.conn = c
 		r.available = true
 		LogInfo("connect to addr:%s ok msgque:%d", r.addr, r.id)
+		r.reconnectAttempts = 0
+		r.resumeConnect()
+		r.connectKeyExchange()
 		if r.handler.OnConnectComplete(r, true) {
 			atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
 			Go(func() {
@@ -258,6 +552,14 @@ func (r *wsMsgQue) connect() {
 }
 
 func (r *wsMsgQue) Reconnect(t int) {
+	if r.init && t < 1 {
+		t = 1
+	}
+	r.reconnectAfter(t * 1000)
+}
+
+//ms毫秒后重连
+func (r *wsMsgQue) reconnectAfter(ms int) {
 	if IsStop() {
 		return
 	}
@@ -271,28 +573,21 @@ func (r *wsMsgQue) Reconnect(t int) {
 		return
 	}
 
-	if r.init {
-		if t < 1 {
-			t = 1
-		}
-	}
 	r.init = true
-	Go(func() {
+	Go2(func(cstop chan struct{}) {
 		if len(r.cwrite) == 0 {
 			r.cwrite <- nil
 		}
 		r.wait.Wait()
-		if t > 0 {
-			SetTimeout(t*1000, func(arg ...interface{}) int {
-				r.stop = 0
-				r.connect()
-				return 0
-			})
-		} else {
+		if r.conn != nil {
+			r.resetKeyExchange()
+		}
+		if r.waitReconnect(ms, cstop) {
 			r.stop = 0
 			r.connect()
+		} else {
+			atomic.CompareAndSwapInt32(&r.connecting, 1, 0)
 		}
-
 	})
 }
 
@@ -355,9 +650,8 @@ func newWsListen(addr, url string, msgtyp MsgType, handler IMsgHandler, parser I
 			parserFactory: parser,
 			connTyp:       ConnTypeListen,
 		},
-		addr:     addr,
-		url:      url,
-		listener: &http.Server{Addr: addr},
+		addr: addr,
+		url:  url,
 	}
 
 	msgqueMapSync.Lock()
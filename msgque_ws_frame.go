@@ -0,0 +1,80 @@
+/*
+@Time       : 2022/8/12
+@Author     : wuqiusheng
+@File       : msgque_ws_frame.go
+@Description: ws帧校验，消息头错误、长度不匹配、超过读取限制的帧计为畸形帧
+			畸形帧按WsOptions.FrameErrType处理，含义同ParseErrType，默认关闭连接
+			ParseErrTypeAlways时以没有消息头的消息投递原始数据
+*/
+package easynet
+
+import (
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+var malformedCount uint64 //所有消息队列收到的畸形帧数量
+
+const wsFrameOverhead = 1024 //默认读取限制中为消息头和json信封预留的长度
+
+func (r *msgQue) MalformedCount() uint64 {
+	return atomic.LoadUint64(&r.malformed)
+}
+
+func (r *msgQue) addMalformed() uint64 {
+	atomic.AddUint64(&malformedCount, 1)
+	return atomic.AddUint64(&r.malformed, 1)
+}
+
+//默认读取限制，MaxMsgDataSize加消息头，文本帧按base64计算
+func (r *WsOptions) readLimit(typ MsgType) int64 {
+	if r != nil && r.ReadLimit > 0 {
+		return r.ReadLimit
+	}
+	limit := int64(MaxMsgDataSize)
+	if typ == MsgTypeMsg {
+		if r != nil && r.Text {
+			limit = (limit + 2) / 3 * 4
+		}
+		limit += wsFrameOverhead
+	}
+	return limit
+}
+
+func (r *WsOptions) frameErrType() ParseErrType {
+	if r == nil || r.FrameErrType == nil {
+		return ParseErrTypeClose
+	}
+	return *r.FrameErrType
+}
+
+//处理解析失败的帧，返回需要投递的消息，返回false时关闭连接
+func (r *wsMsgQue) onMalformedFrame(data []byte, err error) (*Message, bool) {
+	cnt := r.addMalformed()
+	switch r.wsOpts.frameErrType() {
+	case ParseErrTypeSendRemind:
+		LogWarn("msgque:%v malformed frame len:%v err:%v malformed:%v", r.id, len(data), err, cnt)
+		if r.parser != nil {
+			if m := r.parser.GetRemindMsg(err, r.msgTyp); m != nil {
+				r.Send(m)
+			}
+		}
+		return nil, true
+	case ParseErrTypeContinue:
+		LogWarn("msgque:%v malformed frame len:%v err:%v malformed:%v", r.id, len(data), err, cnt)
+		return nil, true
+	case ParseErrTypeAlways:
+		LogWarn("msgque:%v malformed frame len:%v err:%v malformed:%v", r.id, len(data), err, cnt)
+		return &Message{Data: data}, true
+	}
+	LogError("msgque:%v decode msg failed len:%v err:%v malformed:%v", r.id, len(data), err, cnt)
+	return nil, false
+}
+
+//超过读取限制的帧
+func (r *wsMsgQue) onReadErr(err error) {
+	if err == websocket.ErrReadLimit {
+		r.addMalformed()
+	}
+}
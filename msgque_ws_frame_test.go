@@ -0,0 +1,106 @@
+package easynet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//消息头不完整、长度字段与数据不匹配的帧解析失败
+func TestWsDecodeFrame(t *testing.T) {
+	q := &wsMsgQue{}
+	ok := NewMsg(1, 2, []byte("abc")).Bytes()
+	cases := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"ok", ok, true},
+		{"empty", nil, false},
+		{"short head", ok[:MsgHeadSize-1], false},
+		{"short data", ok[:len(ok)-1], false},
+		{"long data", append(append([]byte(nil), ok...), 'x'), false},
+		{"head only", NewMsg(1, 2, nil).Bytes(), true},
+	}
+	for _, c := range cases {
+		msg, err := q.decodeFrame(c.data)
+		if (err == nil) != c.ok {
+			t.Fatal(c.name, err)
+		}
+		if err == nil && msg.Head.Len != uint32(len(msg.Data)) {
+			t.Fatal(c.name, msg.Head.Len, len(msg.Data))
+		}
+	}
+}
+
+//畸形帧按FrameErrType处理，都计入畸形帧数量
+func TestWsMalformedFrame(t *testing.T) {
+	data := []byte{1, 2, 3}
+	cases := []struct {
+		typ   *ParseErrType
+		msg   bool
+		alive bool
+	}{
+		{nil, false, false},
+		{new(ParseErrType), false, true},
+		{func() *ParseErrType { v := ParseErrTypeContinue; return &v }(), false, true},
+		{func() *ParseErrType { v := ParseErrTypeAlways; return &v }(), true, true},
+		{func() *ParseErrType { v := ParseErrTypeClose; return &v }(), false, false},
+	}
+	for i, c := range cases {
+		q := &wsMsgQue{msgQue: msgQue{wsOpts: &WsOptions{FrameErrType: c.typ}}}
+		before := GetStatis().MalformedCount
+		msg, alive := q.onMalformedFrame(data, ErrMsgLenTooShort)
+		if alive != c.alive || (msg != nil) != c.msg || q.MalformedCount() != 1 || GetStatis().MalformedCount-before != 1 {
+			t.Fatal(i, msg, alive, q.MalformedCount())
+		}
+		if msg != nil && (msg.Head != nil || string(msg.Data) != string(data)) {
+			t.Fatal(i, "raw data", msg)
+		}
+	}
+}
+
+//默认关闭连接，跳过时连接保持可用，超过读取限制的帧关闭连接
+func TestWsFrame(t *testing.T) {
+	if err := StartServer("ws://127.0.0.1:29241/close", MsgTypeMsg, &testEchoHandler{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	skip := ParseErrTypeContinue
+	if err := StartServerWithOptions("ws://127.0.0.1:29241/skip", MsgTypeMsg, &testEchoHandler{}, nil, &MsgQueOptions{Ws: &WsOptions{FrameErrType: &skip, ReadLimit: 1024}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	before := GetStatis().MalformedCount
+	conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:29241/close", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3})
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("not closed")
+	}
+
+	conn, _, err = websocket.DefaultDialer.Dial("ws://127.0.0.1:29241/skip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	conn.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3})
+	conn.WriteMessage(websocket.BinaryMessage, append(NewMsg(1, 2, []byte("abc")).Bytes(), 'x'))
+	conn.WriteMessage(websocket.BinaryMessage, NewMsg(1, 2, []byte("ok")).Bytes())
+	if _, data, err := conn.ReadMessage(); err != nil || string(data[MsgHeadSize:]) != "ok" {
+		t.Fatal(data, err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, make([]byte, 1025))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("not closed by read limit")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := GetStatis().MalformedCount - before; n != 4 {
+		t.Fatal("malformed", n)
+	}
+}
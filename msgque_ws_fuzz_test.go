@@ -0,0 +1,22 @@
+//go:build go1.18
+// +build go1.18
+
+package easynet
+
+import (
+	"testing"
+)
+
+//任意数据解析不会panic，解析成功时长度与数据一致
+func FuzzDecodeMsg(f *testing.F) {
+	f.Add(NewMsg(1, 2, []byte("abc")).Bytes())
+	f.Add(NewMsg(1, 2, nil).Bytes())
+	f.Add([]byte{1, 2, 3})
+	q := &msgQue{}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := q.decodeMsg(data)
+		if err == nil && msg.Head.Len != uint32(len(msg.Data)) {
+			t.Fatal(msg.Head.Len, len(msg.Data))
+		}
+	})
+}
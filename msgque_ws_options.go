@@ -0,0 +1,139 @@
+/*
+@Time       : 2022/8/8
+@Author     : wuqiusheng
+@File       : msgque_ws_options.go
+@Description: ws升级参数，Origin白名单，升级鉴权，子协议，压缩，读取限制，客户端请求头
+*/
+package easynet
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//升级前回调，返回错误时拒绝升级，返回的user设置到消息队列
+type WsUpgradeFunc func(req *http.Request) (user interface{}, err error)
+
+//ws参数，监听时对该路径accept的连接生效
+type WsOptions struct {
+	Origins          []string      //允许的Origin，可以是完整的Origin、域名或*.域名，为空时允许所有，没有Origin头的请求总是允许
+	OnUpgrade        WsUpgradeFunc //升级前回调
+	Subprotocols     []string      //支持的子协议，服务器按顺序选择客户端请求的第一个，客户端作为请求的子协议
+	Compression      bool          //开启per-message deflate
+	ReadLimit        int64         //单个消息最大长度，0表示MaxMsgDataSize加消息头
+	ReadBufferSize   int           //读缓冲区大小，0表示4096
+	WriteBufferSize  int           //写缓冲区大小，0表示4096
+	Header           http.Header   //客户端连接时的请求头
+	HandshakeTimeout int           //握手超时 ms，0表示使用默认值
+	Text             bool          //使用文本帧，MsgTypeMsg的消息编码为json信封
+	FrameErrType     *ParseErrType //畸形帧的处理方式，nil表示关闭连接
+}
+
+func (r *WsOptions) bufferSize() (int, int) {
+	read, write := 4096, 4096
+	if r != nil && r.ReadBufferSize > 0 {
+		read = r.ReadBufferSize
+	}
+	if r != nil && r.WriteBufferSize > 0 {
+		write = r.WriteBufferSize
+	}
+	return read, write
+}
+
+//检查Origin是否在白名单中
+func (r *WsOptions) checkOrigin(req *http.Request) bool {
+	if r == nil || len(r.Origins) == 0 {
+		return true
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, v := range r.Origins {
+		v = strings.ToLower(v)
+		if strings.Contains(v, "://") {
+			if v == strings.ToLower(origin) {
+				return true
+			}
+		} else if strings.HasPrefix(v, "*.") {
+			if strings.HasSuffix(host, v[1:]) {
+				return true
+			}
+		} else if v == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *WsOptions) upgrader() *websocket.Upgrader {
+	read, write := r.bufferSize()
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  read,
+		WriteBufferSize: write,
+		CheckOrigin:     r.checkOrigin,
+	}
+	if r != nil {
+		upgrader.Subprotocols = r.Subprotocols
+		upgrader.EnableCompression = r.Compression
+		if r.HandshakeTimeout > 0 {
+			upgrader.HandshakeTimeout = time.Millisecond * time.Duration(r.HandshakeTimeout)
+		}
+	}
+	return upgrader
+}
+
+func (r *WsOptions) dialer() *websocket.Dialer {
+	if r == nil {
+		return websocket.DefaultDialer
+	}
+	read, write := r.bufferSize()
+	dialer := &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  45 * time.Second,
+		ReadBufferSize:    read,
+		WriteBufferSize:   write,
+		Subprotocols:      r.Subprotocols,
+		EnableCompression: r.Compression,
+	}
+	if r.HandshakeTimeout > 0 {
+		dialer.HandshakeTimeout = time.Millisecond * time.Duration(r.HandshakeTimeout)
+	}
+	return dialer
+}
+
+func (r *WsOptions) header() http.Header {
+	if r == nil {
+		return nil
+	}
+	return r.Header
+}
+
+//连接建立后设置读取限制和压缩
+func (r *WsOptions) setConn(conn *websocket.Conn, typ MsgType) {
+	conn.SetReadLimit(r.readLimit(typ))
+	if r != nil && r.Compression {
+		conn.EnableWriteCompression(true)
+	}
+}
+
+func (r *msgQue) Subprotocol() string {
+	return ""
+}
+
+//协商的子协议
+func (r *wsMsgQue) Subprotocol() string {
+	if r.conn != nil {
+		return r.conn.Subprotocol()
+	}
+	return ""
+}
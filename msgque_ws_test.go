@@ -0,0 +1,239 @@
+package easynet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//回应升级时设置的用户数据和协商的子协议
+type testWsUserHandler struct {
+	DefMsgHandler
+}
+
+func (r *testWsUserHandler) OnProcessMsg(msgque IMsgQue, msg *Message) bool {
+	msgque.Send(NewMsg(msg.Id(), msg.Index(), []byte(msgque.GetUser().(string)+"/"+msgque.Subprotocol())))
+	return true
+}
+
+func testWsListen(addr, url string) *wsMsgQue {
+	wsServersSync.Lock()
+	defer wsServersSync.Unlock()
+	if server := wsServers[addr]; server != nil {
+		return server.paths[url]
+	}
+	return nil
+}
+
+func testWsCall(t *testing.T, url string) {
+	c := StartConnect("ws", url, MsgTypeMsg, &DefMsgHandler{}, nil, nil)
+	defer c.Stop()
+	for i := 0; i < 50 && !c.Available(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if m, err := c.Call(ctx, NewMsg(1, 0, []byte(url))); err != nil || string(m.Data) != url {
+		t.Fatal(url, m, err)
+	}
+}
+
+//同一端口多个路径共享http服务，停止的路径返回404，没有路径时关闭http服务，之后可以重新监听
+func TestWsServerRelisten(t *testing.T) {
+	addr := "127.0.0.1:29231"
+	for _, url := range []string{"/a", "/b/"} {
+		if err := StartServer("ws://"+addr+url, MsgTypeMsg, &testEchoHandler{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := StartServer("ws://"+addr+"/a", MsgTypeMsg, &testEchoHandler{}, nil); err != ErrWsPathExist {
+		t.Fatal("path exist", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	testWsCall(t, "ws://"+addr+"/a")
+	testWsCall(t, "ws://"+addr+"/b/c")
+
+	testWsListen(addr, "/a").Stop()
+	time.Sleep(50 * time.Millisecond)
+	resp, err := http.Get("http://" + addr + "/a")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal("stopped path", err)
+	}
+	resp.Body.Close()
+	testWsCall(t, "ws://"+addr+"/b/")
+
+	testWsListen(addr, "/b/").Stop()
+	time.Sleep(50 * time.Millisecond)
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("http server not closed")
+	}
+
+	if err := StartServer("ws://"+addr+"/a", MsgTypeMsg, &testEchoHandler{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	testWsCall(t, "ws://"+addr+"/a")
+}
+
+//挂载到外部mux的路径停止后可以重新挂载
+func TestWsHandlerRelisten(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api", func(hw http.ResponseWriter, hr *http.Request) {})
+	if err := startWsHandler(mux, "/api", MsgTypeMsg, &testEchoHandler{}, nil, nil); err != ErrWsPathExist {
+		t.Fatal("mux path exist", err)
+	}
+	if err := startWsHandler(mux, "/ws", MsgTypeMsg, &testEchoHandler{}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	wsServersSync.Lock()
+	l := wsMuxServers[mux].paths["/ws"]
+	wsServersSync.Unlock()
+	if err := startWsHandler(mux, "/ws", MsgTypeMsg, &testEchoHandler{}, nil, nil); err != ErrWsPathExist {
+		t.Fatal("path exist", err)
+	}
+	l.Stop()
+	time.Sleep(50 * time.Millisecond)
+	if err := startWsHandler(mux, "/ws", MsgTypeMsg, &testEchoHandler{}, nil, nil); err != nil {
+		t.Fatal("relisten", err)
+	}
+}
+
+//Origin白名单支持完整Origin、域名和*.域名
+func TestWsCheckOrigin(t *testing.T) {
+	opts := &WsOptions{Origins: []string{"https://a.com", "b.com", "*.game.com"}}
+	cases := map[string]bool{
+		"":                     true,
+		"https://a.com":        true,
+		"http://a.com":         false,
+		"http://b.com:8080":    true,
+		"https://h5.game.com":  true,
+		"https://game.com":     false,
+		"https://evilgame.com": false,
+		"https://evil.com":     false,
+		"://bad":               false,
+	}
+	for origin, want := range cases {
+		req := &http.Request{Header: http.Header{}}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if opts.checkOrigin(req) != want {
+			t.Fatal(origin, want)
+		}
+	}
+}
+
+//Origin不在白名单时不回调OnUpgrade，OnUpgrade返回错误时拒绝升级，返回的用户数据设置到消息队列，协商子协议
+func TestWsOptions(t *testing.T) {
+	var upgrades int32
+	opts := &MsgQueOptions{Ws: &WsOptions{
+		Origins:      []string{"*.game.com"},
+		Subprotocols: []string{"v2", "v1"},
+		Compression:  true,
+		OnUpgrade: func(req *http.Request) (interface{}, error) {
+			atomic.AddInt32(&upgrades, 1)
+			if req.Header.Get("Token") != "ok" {
+				return nil, errors.New("no token")
+			}
+			return "player1", nil
+		},
+	}}
+	if err := StartServerWithOptions("ws://127.0.0.1:29232/opt", MsgTypeMsg, &testWsUserHandler{}, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	h := http.Header{"Token": {"ok"}, "Origin": {"https://h5.game.com"}}
+	c := StartConnectWithOptions("ws", "ws://127.0.0.1:29232/opt", MsgTypeMsg, &DefMsgHandler{}, nil, nil, &MsgQueOptions{Ws: &WsOptions{Header: h, Subprotocols: []string{"v1"}, Compression: true}})
+	defer c.Stop()
+	for i := 0; i < 50 && !c.Available(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if m, err := c.Call(ctx, NewMsg(1, 0, []byte("x"))); err != nil || string(m.Data) != "player1/v1" || c.Subprotocol() != "v1" {
+		t.Fatal(m, err)
+	}
+
+	for _, h := range []http.Header{{"Token": {"bad"}}, {"Token": {"ok"}, "Origin": {"https://evil.com"}}} {
+		_, resp, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:29232/opt", h)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatal("upgrade accepted", h, err)
+		}
+	}
+	if n := atomic.LoadInt32(&upgrades); n != 2 {
+		t.Fatal("upgrades", n)
+	}
+}
+
+//json数据放在data字段，其他数据和带标记的数据放在bin字段，解析后还原
+func TestWsTextEnvelope(t *testing.T) {
+	cases := []struct {
+		flags uint8
+		data  string
+		field string
+	}{
+		{0, `{"a":[1,2]}`, `"data":{"a":[1,2]}`},
+		{0, "\x00\x01\xff", `"bin":"AAH/"`},
+		{FlagCompress, `{"a":1}`, `"bin":`},
+		{0, "", `{"id":3,"index":7}`},
+	}
+	for _, c := range cases {
+		m := NewMsg(3, 7, []byte(c.data))
+		m.Head.Flags = c.flags
+		data, err := encodeWsText(m)
+		if err != nil || !strings.Contains(string(data), c.field) {
+			t.Fatal(string(data), err)
+		}
+		got, err := decodeWsText(data)
+		if err != nil || got.Id() != 3 || got.Index() != 7 || got.Flags() != c.flags || string(got.Data) != c.data || got.Len() != uint32(len(c.data)) {
+			t.Fatal(string(data), err)
+		}
+	}
+	if _, err := decodeWsText([]byte("not json")); err == nil {
+		t.Fatal("bad envelope decoded")
+	}
+}
+
+//文本帧模式与浏览器和easynet客户端通信，收到无法解析的帧时关闭连接
+func TestWsText(t *testing.T) {
+	opts := &MsgQueOptions{Ws: &WsOptions{Text: true}}
+	if err := StartServerWithOptions("ws://127.0.0.1:29233/text", MsgTypeMsg, &testEchoHandler{}, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:29233/text", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":3,"index":7,"data":{"a":1}}`))
+	typ, data, err := conn.ReadMessage()
+	if err != nil || typ != websocket.TextMessage || string(data) != `{"id":3,"index":7,"data":{"a":1}}` {
+		t.Fatal(typ, string(data), err)
+	}
+
+	c := StartConnectWithOptions("ws", "ws://127.0.0.1:29233/text", MsgTypeMsg, &DefMsgHandler{}, nil, nil, opts)
+	defer c.Stop()
+	for i := 0; i < 50 && !c.Available(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if m, err := c.Call(ctx, NewMsg(1, 0, []byte{0, 1, 2})); err != nil || string(m.Data) != "\x00\x01\x02" {
+		t.Fatal(m, err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("not closed")
+	}
+}
@@ -0,0 +1,82 @@
+/*
+@Time       : 2022/8/10
+@Author     : wuqiusheng
+@File       : msgque_ws_text.go
+@Description: ws文本帧模式，用于浏览器和H5客户端
+			MsgTypeMsg的消息使用json信封 {"id":1,"index":0,"flags":0,"data":{...}}，data为原始json，配合JsonParser使用
+			数据不是json或经过加密、压缩、分片时使用"bin"字段，值为base64
+			MsgTypeCmd直接发送文本帧
+*/
+package easynet
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+type wsTextEnvelope struct {
+	Id    uint16          `json:"id"`
+	Index uint16          `json:"index"`
+	Flags uint8           `json:"flags,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Bin   []byte          `json:"bin,omitempty"`
+}
+
+func (r *wsMsgQue) textMode() bool {
+	return r.wsOpts != nil && r.wsOpts.Text
+}
+
+//解析收到的帧
+func (r *wsMsgQue) decodeFrame(data []byte) (*Message, error) {
+	if r.textMode() {
+		return decodeWsText(data)
+	}
+	return r.decodeMsg(data)
+}
+
+//编码要发送的帧，返回帧类型
+func (r *wsMsgQue) encodeFrame(m *Message) (int, []byte, bool, error) {
+	if !r.textMode() {
+		data, pooled := r.encodeMsg(m)
+		return websocket.BinaryMessage, data, pooled, nil
+	}
+	if m.Head == nil {
+		return websocket.TextMessage, m.Data, false, nil
+	}
+	data, err := encodeWsText(m)
+	return websocket.TextMessage, data, false, err
+}
+
+//编码为json信封
+func encodeWsText(m *Message) ([]byte, error) {
+	env := wsTextEnvelope{Id: m.Head.Id, Index: m.Head.Index, Flags: m.Head.Flags}
+	data := m.Data[:m.Head.Len]
+	if len(data) > 0 {
+		if m.Head.Flags&(FlagEncrypt|FlagCompress|FlagContinue) == 0 && json.Valid(data) {
+			env.Data = data
+		} else {
+			env.Bin = data
+		}
+	}
+	return json.Marshal(&env)
+}
+
+//解析json信封
+func decodeWsText(data []byte) (*Message, error) {
+	env := wsTextEnvelope{}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	msg := &Message{Head: &MessageHead{Id: env.Id, Index: env.Index, Flags: env.Flags}}
+	if len(env.Bin) > 0 {
+		msg.Data = env.Bin
+	} else if len(env.Data) > 0 {
+		msg.Data = env.Data
+	}
+	msg.Head.Len = uint32(len(msg.Data))
+	if msg.Head.Len > MaxMsgDataSize {
+		return nil, ErrMsgLenTooLong
+	}
+	return msg, nil
+}
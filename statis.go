@@ -15,20 +15,22 @@ func GetStatis() *Statis {
 	statis.GoCount = int(atomic.LoadInt32(&gocount))
 	statis.PoolGoCount = atomic.LoadInt32(&poolGoCount)
 	statis.MsgqueCount = len(msgqueMap)
+	statis.MalformedCount = atomic.LoadUint64(&malformedCount)
 	return statis
 }
 
 //性能统计单协程上报
 type Statis struct {
-	GoCount     int       //进程协程协程数
-	PoolGoCount int32     //协程池协程数
-	MsgqueCount int       //消息队列数量
-	StartTime   time.Time //启动时间
-	LastPanic   int64     //最近panic时间
-	PanicCount  int32     //panic次数
-	cpuPercent  float32   //cpu使用率
-	memPercent  float32   //内存使用率
-	diskPercent float32   // 磁盘使用率
+	GoCount        int       //进程协程协程数
+	PoolGoCount    int32     //协程池协程数
+	MsgqueCount    int       //消息队列数量
+	StartTime      time.Time //启动时间
+	LastPanic      int64     //最近panic时间
+	PanicCount     int32     //panic次数
+	MalformedCount uint64    //收到的畸形帧数量
+	cpuPercent     float32   //cpu使用率
+	memPercent     float32   //内存使用率
+	diskPercent    float32   // 磁盘使用率
 }
 
 //